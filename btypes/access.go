@@ -0,0 +1,141 @@
+package btypes
+
+import (
+	"sort"
+	"sync"
+)
+
+// PermissionAll 拥有所有权限
+const PermissionAll = "*"
+
+// TopicRouter 订阅websocket topic时检查权限使用的路由
+// 比如 Require(TopicRouter("orders"), "orders/read")，table/id使用该表的
+func TopicRouter(topic string) string { return "topic:" + topic }
+
+// RoutePermissioner 代表Tabler声明了自己注册的路由需要的权限
+// 路由 => 权限，权限为空时使用路由本身，比如 "user/delete"
+type RoutePermissioner interface {
+	RoutePermissions() map[string]string
+}
+
+// AccessControl 基于角色的权限控制
+// 没有声明权限的路由，所有人都可以访问
+type AccessControl struct {
+	mu     sync.RWMutex
+	routes map[string]string              // 路由 => 需要的权限
+	roles  map[string]map[string]struct{} // 角色 => 拥有的权限
+}
+
+// AccessMatrix 是AccessControl的快照，用于查看
+type AccessMatrix struct {
+	Routes map[string]string   `json:"routes"`
+	Roles  map[string][]string `json:"roles"`
+}
+
+func NewAccessControl() *AccessControl {
+	return &AccessControl{
+		routes: make(map[string]string),
+		roles:  make(map[string]map[string]struct{}),
+	}
+}
+
+// Require 设置router需要的权限，permission为空时使用router本身
+func (ac *AccessControl) Require(router, permission string) *AccessControl {
+	if permission == "" {
+		permission = router
+	}
+	ac.mu.Lock()
+	ac.routes[router] = permission
+	ac.mu.Unlock()
+	return ac
+}
+
+// Grant 赋予角色权限
+func (ac *AccessControl) Grant(role string, permissions ...string) *AccessControl {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	perms, ok := ac.roles[role]
+	if !ok {
+		perms = make(map[string]struct{}, len(permissions))
+		ac.roles[role] = perms
+	}
+	for _, permission := range permissions {
+		perms[permission] = struct{}{}
+	}
+	return ac
+}
+
+// Permission 返回router需要的权限，为空代表不需要权限
+func (ac *AccessControl) Permission(router string) string {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	return ac.routes[router]
+}
+
+// Allowed sess是否拥有permission, 包括session直接携带的权限以及其角色的权限
+func (ac *AccessControl) Allowed(sess JwtSession, permission string) bool {
+	if permission == "" {
+		return true
+	}
+	if sess == nil {
+		return false
+	}
+
+	if ps, ok := sess.(PermissionSession); ok {
+		for _, p := range ps.Permissions() {
+			if p == permission || p == PermissionAll {
+				return true
+			}
+		}
+	}
+
+	rs, ok := sess.(RoleSession)
+	if !ok {
+		return false
+	}
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+	for _, role := range rs.Roles() {
+		perms := ac.roles[role]
+		if _, ok := perms[permission]; ok {
+			return true
+		}
+		if _, ok := perms[PermissionAll]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize 检查sess能否访问router，不能则返回*ForbiddenError
+func (ac *AccessControl) Authorize(sess JwtSession, router string) error {
+	permission := ac.Permission(router)
+	if ac.Allowed(sess, permission) {
+		return nil
+	}
+	return &ForbiddenError{Router: router, Permission: permission}
+}
+
+// Matrix 返回当前的权限矩阵
+func (ac *AccessControl) Matrix() AccessMatrix {
+	ac.mu.RLock()
+	defer ac.mu.RUnlock()
+
+	matrix := AccessMatrix{
+		Routes: make(map[string]string, len(ac.routes)),
+		Roles:  make(map[string][]string, len(ac.roles)),
+	}
+	for router, permission := range ac.routes {
+		matrix.Routes[router] = permission
+	}
+	for role, perms := range ac.roles {
+		list := make([]string, 0, len(perms))
+		for permission := range perms {
+			list = append(list, permission)
+		}
+		sort.Strings(list)
+		matrix.Roles[role] = list
+	}
+	return matrix
+}
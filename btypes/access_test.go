@@ -0,0 +1,48 @@
+package btypes_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/stretchr/testify/assert"
+)
+
+type roleSession struct {
+	ID    uint
+	roles []string
+	perms []string
+}
+
+func (*roleSession) New() btypes.JwtSession  { return &roleSession{} }
+func (s *roleSession) UserID() uint          { return s.ID }
+func (s *roleSession) Roles() []string       { return s.roles }
+func (s *roleSession) Permissions() []string { return s.perms }
+
+func TestAccessControl(t *testing.T) {
+	ac := btypes.NewAccessControl().
+		Require("user/delete", "").
+		Require("user/update", "user/write").
+		Grant("admin", btypes.PermissionAll).
+		Grant("editor", "user/write")
+
+	admin := &roleSession{ID: 1, roles: []string{"admin"}}
+	editor := &roleSession{ID: 2, roles: []string{"editor"}}
+	deleter := &roleSession{ID: 3, perms: []string{"user/delete"}}
+
+	assert.NoError(t, ac.Authorize(admin, "user/delete"))
+	assert.NoError(t, ac.Authorize(editor, "user/update"))
+	assert.NoError(t, ac.Authorize(deleter, "user/delete"))
+	// 没有声明权限的路由都可以访问
+	assert.NoError(t, ac.Authorize(nil, "user/query"))
+
+	err := ac.Authorize(editor, "user/delete")
+	assert.True(t, errors.Is(err, btypes.ErrForbidden))
+	var forbidden *btypes.ForbiddenError
+	assert.True(t, errors.As(err, &forbidden))
+	assert.Equal(t, "user/delete", forbidden.Permission)
+
+	matrix := ac.Matrix()
+	assert.Equal(t, map[string]string{"user/delete": "user/delete", "user/update": "user/write"}, matrix.Routes)
+	assert.Equal(t, []string{"user/write"}, matrix.Roles["editor"])
+}
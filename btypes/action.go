@@ -14,7 +14,8 @@ type ContextConfig func(*Context) error
 // jwtSession: 目的是将jwt的需求构造成一个结构体，发送给客户端就可以里，这个Context也完成使命被回收了
 func HandlerFunc(tabler Tabler, parameter Parameter, jwtSession JwtSession, handlers ...Action) ContextConfig {
 	return func(c *Context) error {
-		tabler = tabler.New()
+		// 每个请求使用自己的tabler，不能赋值给闭包中共用的tabler
+		tabler := tabler.New()
 
 		err := parameter.FromRawMessage(tabler, c.Request.Payload)
 		if err != nil {
@@ -1,5 +1,10 @@
 package btypes
 
+import (
+	"sync"
+	"time"
+)
+
 // Cacher 目标是将客户端请求Cache化
 // 每个请求都不一致，所以对请求做hash, 保证请求一致时可以用缓存
 // 如果对表进行了Update/Delete/Insert，将该表所有缓存删除
@@ -11,3 +16,64 @@ type Cacher interface {
 	SetBucket(string, string, []byte)
 	ClearBuckets(...string)
 }
+
+// ExpireCacher 可选，Cacher支持设置有过期时间的值
+type ExpireCacher interface {
+	SetWithExpire(interface{}, interface{}, time.Duration)
+}
+
+// Incrementer 可选，Cacher支持原子地将int64值加1，比如多实例共用的redis
+// 计数用于撤销及尝试次数的限制，与DurableCacher一样不能因容量被淘汰
+type Incrementer interface {
+	Increment(key interface{}, ttl time.Duration) int64
+}
+
+// DurableCacher 可选，SetDurable保存的值不会因容量被淘汰，只在ttl后过期
+// 撤销记录、不透明session及登录失败记录被淘汰后，撤销或限制就失效了
+type DurableCacher interface {
+	SetDurable(key, value interface{}, ttl time.Duration)
+}
+
+// SetWithExpire Cacher没有实现ExpireCacher时使用Set，值不会过期
+func SetWithExpire(cacher Cacher, key, value interface{}, ttl time.Duration) {
+	if ec, ok := cacher.(ExpireCacher); ok {
+		ec.SetWithExpire(key, value, ttl)
+		return
+	}
+	cacher.Set(key, value)
+}
+
+// SetDurable Cacher没有实现DurableCacher时使用SetWithExpire，需保证该Cacher不会淘汰这些值
+func SetDurable(cacher Cacher, key, value interface{}, ttl time.Duration) {
+	if dc, ok := cacher.(DurableCacher); ok {
+		dc.SetDurable(key, value, ttl)
+		return
+	}
+	SetWithExpire(cacher, key, value, ttl)
+}
+
+var incrementMu sync.Mutex
+
+// Increment 原子地将key的int64值加1并返回新值，ttl是新值的过期时间
+// Cacher没有实现Incrementer时只在本进程内加锁，多实例时不是原子的
+func Increment(cacher Cacher, key interface{}, ttl time.Duration) int64 {
+	if incr, ok := cacher.(Incrementer); ok {
+		return incr.Increment(key, ttl)
+	}
+
+	incrementMu.Lock()
+	defer incrementMu.Unlock()
+
+	var n int64
+	if v, ok := cacher.Get(key); ok {
+		n = v.(int64)
+	}
+	n++
+	SetDurable(cacher, key, n, ttl)
+	return n
+}
+
+// Warmer 写操作成功后，对被清除缓存的表重新预热
+type Warmer interface {
+	Warm(tableNames ...string)
+}
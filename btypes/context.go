@@ -15,6 +15,13 @@ type Executor struct {
 	Results []PairStringer
 }
 
+// Notifier 向指定用户的所有websocket连接推送，比如"导出已完成"
+// 用户不在线时丢弃
+type Notifier interface {
+	SendToUser(userID uint, resp Responder)
+	SendToUsers(userIDs []uint, resp Responder)
+}
+
 type Context struct {
 	// 连接类型
 	ConnectionType
@@ -26,6 +33,14 @@ type Context struct {
 	Depends map[string]map[string]struct{}
 	// 开启悲观锁的表
 	PessimisticLock map[string]struct{}
+	// 写操作后的缓存预热，可以为nil
+	Warmer Warmer
+	// 权限控制
+	AccessControl *AccessControl
+	// 悲观锁
+	Locks *LockRegistry
+	// 向指定用户推送，可以为nil
+	Notifier Notifier
 	// 日志
 	logger.Logger
 	// JWT
@@ -51,6 +66,8 @@ type Context struct {
 	Responder
 	// 此处应答是否成功
 	Success bool
+	// 应答失败时的错误
+	Err error
 }
 
 func (ctx *Context) Init(db *DB, cacher Cacher, client *ws.Client,
@@ -76,6 +93,7 @@ func (ctx *Context) Init(db *DB, cacher Cacher, client *ws.Client,
 	ctx.Executor.cursor = 0
 	ctx.Results = nil
 	ctx.Success = false
+	ctx.Err = nil
 	ctx.Responder = nil
 }
 
@@ -110,9 +128,15 @@ func (c *Context) exec() {
 	}
 }
 
+// CacheKey 计算该请求的缓存键，如果Tabler的查询依赖JwtSession，会加入session的范围
+func (c *Context) CacheKey() string {
+	return c.BuildCacheKey(ScopedRequestType(c.Tabler, c.JwtSess, c.Request.Type))
+}
+
 func (c *Context) BuildResponse(result Result, err error) (response *Response) {
 	if err != nil {
 		response = BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
+		c.Err = err
 	} else {
 		response = BuildFromRequest(c.ConfigResponseType, c.Request, true, result.Broadcast)
 		response.Add(result.Payloads...)
@@ -5,4 +5,40 @@ import "gorm.io/gorm"
 // DB ...
 type DB struct {
 	Gorm *gorm.DB
+	// 行级安全的范围，修改及删除时自动加上
+	scope *RowScope
+}
+
+// WithRowScope 返回带有行级安全范围的DB，scope为nil时返回db本身
+func (db *DB) WithRowScope(scope *RowScope) *DB {
+	if scope == nil {
+		return db
+	}
+	return &DB{Gorm: db.Gorm, scope: scope}
+}
+
+// create 插入tabler，带有行级安全范围时在事务中插入，插入的数据不在范围内则回滚并返回ErrForbidden
+func (db *DB) create(tabler Tabler) error {
+	if db.scope == nil {
+		return db.Gorm.Create(tabler).Error
+	}
+	return db.Gorm.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(tabler).Error; err != nil {
+			return err
+		}
+		if !(&DB{Gorm: tx, scope: db.scope}).inScope(tabler, tabler.Model().ID) {
+			return ErrForbidden
+		}
+		return nil
+	})
+}
+
+// inScope 在范围内是否存在该数据
+func (db *DB) inScope(tabler Tabler, id uint) bool {
+	var n int64
+	if err := db.Gorm.Model(tabler.New()).Where("id = ?", id).
+		Where(db.scope.Query, db.scope.Args...).Count(&n).Error; err != nil {
+		panic(err)
+	}
+	return n > 0
 }
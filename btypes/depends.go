@@ -0,0 +1,93 @@
+package btypes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ResolveDepends 根据Tabler.Depends()构建缓存失效的依赖图
+// 返回: 表名 => 该表改变时需要清除缓存的所有表，是传递闭包(C依赖B，B依赖A，则A改变时清除B和C)，不包含自身
+// 如果依赖之间存在环，返回的error会列出环的路径
+func ResolveDepends(tablers []Tabler) (map[string]map[string]struct{}, error) {
+	// edges: 被依赖的表 => 直接依赖它的表
+	edges := make(map[string][]string)
+	for _, tabler := range tablers {
+		tableName := tabler.TableName()
+		for _, depend := range tabler.Depends() {
+			edges[depend] = append(edges[depend], tableName)
+		}
+	}
+
+	// 保证遍历顺序一致，报告的环也一致
+	nodes := make([]string, 0, len(edges))
+	for node, dependents := range edges {
+		nodes = append(nodes, node)
+		sort.Strings(dependents)
+	}
+	sort.Strings(nodes)
+
+	if cycle := findCycle(nodes, edges); cycle != nil {
+		return nil, fmt.Errorf("缓存依赖存在环: %s", strings.Join(cycle, " -> "))
+	}
+
+	depends := make(map[string]map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		closure := make(map[string]struct{})
+		stack := append([]string(nil), edges[node]...)
+		for len(stack) > 0 {
+			current := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if _, ok := closure[current]; ok {
+				continue
+			}
+			closure[current] = struct{}{}
+			stack = append(stack, edges[current]...)
+		}
+		depends[node] = closure
+	}
+	return depends, nil
+}
+
+// findCycle 深度优先查找环，返回环上的路径(首尾相同)，没有环返回nil
+func findCycle(nodes []string, edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+
+	var visit func(node string) []string
+	visit = func(node string) []string {
+		state[node] = visiting
+		path = append(path, node)
+		for _, next := range edges[node] {
+			switch state[next] {
+			case visiting:
+				for i := range path {
+					if path[i] == next {
+						return append(append([]string(nil), path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[node] = visited
+		return nil
+	}
+
+	for _, node := range nodes {
+		if state[node] == unvisited {
+			if cycle := visit(node); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package btypes_test
+
+import (
+	"testing"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/stretchr/testify/assert"
+)
+
+type dependTable struct {
+	btypes.VirtualTable
+	name    string
+	depends []string
+}
+
+func (dt *dependTable) TableName() string { return dt.name }
+func (dt *dependTable) Depends() []string { return dt.depends }
+
+func TestResolveDepends(t *testing.T) {
+	depends, err := btypes.ResolveDepends([]btypes.Tabler{
+		&dependTable{name: "a"},
+		&dependTable{name: "b", depends: []string{"a"}},
+		&dependTable{name: "c", depends: []string{"b"}},
+		&dependTable{name: "d", depends: []string{"a", "c"}},
+	})
+	assert.NoError(t, err)
+
+	// a改变时，b,c,d都要清除缓存
+	assert.Equal(t, map[string]struct{}{"b": {}, "c": {}, "d": {}}, depends["a"])
+	assert.Equal(t, map[string]struct{}{"c": {}, "d": {}}, depends["b"])
+	assert.Equal(t, map[string]struct{}{"d": {}}, depends["c"])
+	assert.NotContains(t, depends, "d")
+}
+
+func TestResolveDependsCycle(t *testing.T) {
+	_, err := btypes.ResolveDepends([]btypes.Tabler{
+		&dependTable{name: "a", depends: []string{"c"}},
+		&dependTable{name: "b", depends: []string{"a"}},
+		&dependTable{name: "c", depends: []string{"b"}},
+	})
+	assert.EqualError(t, err, "缓存依赖存在环: a -> b -> c -> a")
+}
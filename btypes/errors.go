@@ -1,12 +1,57 @@
 package btypes
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 var (
 	ErrOptimisticLock                      = errors.New("乐观锁错误: 数据已经被修改，请刷新后重新请求")
 	ErrAccountNotExistOrPasswordNotCorrect = errors.New("账号不存在或密码错误")
+	ErrAccountExists                       = errors.New("账号已存在")
+	ErrWeakPassword                        = errors.New("密码强度不够")
 	ErrInvalidToken                        = errors.New("无效的token")
 	ErrTokenExpired                        = errors.New("token过期")
+	ErrCacheRebuildTimeout                 = errors.New("等待缓存重建超时，请稍后重试")
+	ErrCacheRebuildFailed                  = errors.New("缓存重建失败")
+	ErrForbidden                           = errors.New("没有权限")
+	ErrRecordNotFound                      = errors.New("数据不存在")
+	ErrAccountLocked                       = errors.New("登录失败次数过多，已被暂时锁定")
+	ErrInvalidTOTP                         = errors.New("验证码错误")
+	ErrLockedByOther                       = errors.New("数据已被其他用户锁定")
+	ErrLockNotHeld                         = errors.New("未持有该锁或租约已过期")
+	ErrLockLimit                           = errors.New("持有的锁已达上限")
 
 	ErrStringUniqueConstrait = "unique constraint"
 )
+
+// ForbiddenError 代表请求的路由需要的权限，session没有
+// errors.Is(err, ErrForbidden) 为true
+type ForbiddenError struct {
+	Router     string
+	Permission string
+}
+
+func (e *ForbiddenError) Error() string {
+	return fmt.Sprintf("%s: %q 需要权限 %q", ErrForbidden.Error(), e.Router, e.Permission)
+}
+
+func (e *ForbiddenError) Is(target error) bool { return target == ErrForbidden }
+
+// LockedError 登录失败次数过多，RetryAfter之后才能再次尝试
+// errors.Is(err, ErrAccountLocked) 为true
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s，请%d秒后重试", ErrAccountLocked.Error(), e.RetryAfterSeconds())
+}
+
+func (e *LockedError) Is(target error) bool { return target == ErrAccountLocked }
+
+// RetryAfterSeconds 向上取整的秒数
+func (e *LockedError) RetryAfterSeconds() int64 {
+	return int64((e.RetryAfter + time.Second - 1) / time.Second)
+}
@@ -1,6 +1,7 @@
 package btypes
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -29,15 +30,23 @@ func (*GormModel) Size() int             { return 20 }
 func (*GormModel) Orderby() string       { return "updated_at DESC" }
 
 // update 数据，直接Save，保存所有数据，同时因为如果version不一致就返回0行，所以是乐观锁错误
+// 如果db带有行级安全范围，范围外的数据返回ErrRecordNotFound
 func (model *GormModel) UpdateWithOmits(db *DB, tabler Tabler, omits ...string) error {
 	model.Version++
-	tx := db.Gorm.Model(tabler).Where("version = ?", model.Version-1).
-		Omit("deleted_at").Omit(omits...).Save(tabler)
+	// 明确Select("*")，避免Save在version不一致(没有更新到数据)时改为插入
+	tx := db.Gorm.Model(tabler).Where("version = ?", model.Version-1).Select("*")
+	if db.scope != nil {
+		tx = tx.Where(db.scope.Query, db.scope.Args...)
+	}
+	tx = tx.Omit("deleted_at").Omit(omits...).Save(tabler)
 
 	if err := tx.Error; err != nil {
 		panic(err)
 	}
 	if tx.RowsAffected == 0 {
+		if db.scope != nil && !db.inScope(tabler, model.ID) {
+			return ErrRecordNotFound
+		}
 		return ErrOptimisticLock
 	}
 	return nil
@@ -50,11 +59,18 @@ func (model *GormModel) delete(db *DB, tabler Tabler, hardDelete bool) (int64, e
 		tx = db.Gorm.Unscoped()
 	}
 
-	tx = tx.Where("version = ?", model.Version).Delete(tabler)
+	tx = tx.Where("version = ?", model.Version)
+	if db.scope != nil {
+		tx = tx.Where(db.scope.Query, db.scope.Args...)
+	}
+	tx = tx.Delete(tabler)
 	if err := tx.Error; err != nil {
 		panic(err)
 	}
 	if tx.RowsAffected == 0 {
+		if db.scope != nil && !db.inScope(tabler, model.ID) {
+			return 0, ErrRecordNotFound
+		}
 		return 0, ErrOptimisticLock
 	}
 
@@ -72,11 +88,15 @@ func (model *GormModel) SoftDelete(db *DB, tabler Tabler) (int64, error) {
 func (model *GormModel) Model() *GormModel { return model }
 
 // insert 插入新数据时有可能会违反独一约束，则需要处理该类错误，需在tabler内部处理
+// 带有行级安全范围时，插入范围外的数据返回ErrForbidden
 func (*GormModel) Insert(c *Context, tabler Tabler, jwtSess JwtSession) (result Result, err error) {
-	if err = c.DB.Gorm.Create(tabler).Error; err == nil {
+	if err = c.DB.create(tabler); err == nil {
 		result.Payloads.Add("msg", "添加成功")
 		return
 	}
+	if errors.Is(err, ErrForbidden) {
+		return
+	}
 
 	if strings.Contains(err.Error(), ErrStringUniqueConstrait) {
 		return
@@ -87,15 +107,6 @@ func (*GormModel) Insert(c *Context, tabler Tabler, jwtSess JwtSession) (result
 func (model *GormModel) Delete(c *Context, tabler Tabler, jwtSession JwtSession) (result Result, err error) {
 	c.Logger.Infof("delete %#v", tabler)
 
-	if tabler.PessimisticLock() {
-		writeLockKey := fmt.Sprintf("%s/%d", tabler.TableName(), model.ID)
-		userid, ok := c.Cacher.Get(writeLockKey)
-		if ok {
-			err = fmt.Errorf("目前该数据%q已被其他客户端:%v锁住，不能删除", writeLockKey, userid)
-			return
-		}
-	}
-
 	var n int64
 	n, err = tabler.Model().SoftDelete(c.DB, tabler)
 	if err == nil {
@@ -4,3 +4,18 @@ type JwtSession interface {
 	New() JwtSession
 	UserID() uint
 }
+
+// RoleSession 代表session携带了角色，用于权限控制
+type RoleSession interface {
+	Roles() []string
+}
+
+// NamedSession 代表session可以显示给其他用户的名字，比如悲观锁的持有者
+type NamedSession interface {
+	DisplayName() string
+}
+
+// PermissionSession 代表session直接携带了权限，用于权限控制
+type PermissionSession interface {
+	Permissions() []string
+}
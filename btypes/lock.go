@@ -0,0 +1,372 @@
+package btypes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eruca/bisel/ws"
+)
+
+const (
+	// PermissionLockOverride 拥有该权限的用户可以解除他人持有的悲观锁
+	PermissionLockOverride = "lock/override"
+	// PermissionLockAdmin 拥有该权限的用户可以查看所有的锁及强制释放
+	PermissionLockAdmin = "lock/admin"
+)
+
+// LockLease 悲观锁的租约，到Expires时自动释放，持有者需要在到期前续租
+// 租约不会被修改，续租时产生新的租约
+type LockLease struct {
+	Key    string `json:"key"`
+	UserID uint   `json:"user_id"`
+	// Holder 持有者的名字，session实现了NamedSession时才有
+	Holder   string    `json:"holder,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// NewLockLease 以sess作为持有者
+func NewLockLease(key string, sess JwtSession, acquired, expires time.Time) *LockLease {
+	lease := &LockLease{Key: key, UserID: sess.UserID(), Acquired: acquired, Expires: expires}
+	if named, ok := sess.(NamedSession); ok {
+		lease.Holder = named.DisplayName()
+	}
+	return lease
+}
+
+// TableName 租约所在的表，Key是 table/id
+func (l *LockLease) TableName() string {
+	if i := strings.LastIndexByte(l.Key, '/'); i >= 0 {
+		return l.Key[:i]
+	}
+	return l.Key
+}
+
+// String 用于日志及错误信息
+func (l *LockLease) String() string {
+	holder := fmt.Sprint(l.UserID)
+	if l.Holder != "" {
+		holder = fmt.Sprintf("%s(%d)", l.Holder, l.UserID)
+	}
+	return fmt.Sprintf("%s 由 %s 于 %s 获取", l.Key, holder, l.Acquired.Format("2006-01-02 15:04:05"))
+}
+
+const (
+	// PushTypeLockChanged 锁状态改变时发布到该表及table/id的topic，payload是LockEvent
+	PushTypeLockChanged = "lock/changed"
+	// PushTypeLocks 已认证的连接建立时推送某个表当前的锁，payload: {"table": ..., "locks": [...]}
+	PushTypeLocks = "lock/list"
+)
+
+// LockEvent 锁状态的改变
+type LockEvent struct {
+	Event  string     `json:"event"`            // acquired/released
+	Reason string     `json:"reason,omitempty"` // 释放的原因
+	Lease  *LockLease `json:"lease"`
+}
+
+const (
+	LockAcquired = "acquired"
+	LockReleased = "released"
+
+	ReleaseUnlock     = "unlock"
+	ReleaseExpired    = "expired"
+	ReleaseDisconnect = "disconnect"
+	ReleaseLogout     = "logout"
+	ReleaseForced     = "forced"
+)
+
+// LockInfo 管理用，包括获取锁的websocket连接，http请求获取时为空
+type LockInfo struct {
+	*LockLease
+	ConnID   uint64 `json:"conn_id,omitempty"`
+	ConnAddr string `json:"conn_addr,omitempty"`
+}
+
+// LockKey 悲观锁的键: table/id
+func LockKey(tableName string, id uint) string {
+	return fmt.Sprintf("%s/%d", tableName, id)
+}
+
+// ***************************** LockRegistry *********************************
+
+// lockEntry 登记的锁，client是获取该锁的websocket连接，http请求时为nil
+type lockEntry struct {
+	lease  *LockLease
+	client *ws.Client
+	timer  *time.Timer
+}
+
+// LockRegistry 悲观锁的登记处，按键、用户及连接索引
+// 一个用户可以持有多个锁，连接断开或登出时一起释放
+// 只保存在本进程的内存中，不经过Cacher: 多个实例之间不共享，进程重启后所有的锁都被释放
+// 多实例部署时需要让同一张表的写请求落在同一个实例上(比如按表路由)，否则悲观锁不起作用
+type LockRegistry struct {
+	mu     sync.Mutex
+	byKey  map[string]*lockEntry
+	byUser map[uint]map[string]struct{}
+	byConn map[*ws.Client]map[string]struct{}
+	// 每个用户最多持有的锁，0表示不限制
+	limit int
+	// 锁被获取或释放时调用，在锁外调用
+	onChange func(LockEvent)
+}
+
+// NewLockRegistry limit: 每个用户最多持有的锁，0表示不限制
+func NewLockRegistry(limit int) *LockRegistry {
+	return &LockRegistry{
+		byKey:  make(map[string]*lockEntry),
+		byUser: make(map[uint]map[string]struct{}),
+		byConn: make(map[*ws.Client]map[string]struct{}),
+		limit:  limit,
+	}
+}
+
+// SetLimit 设置每个用户最多持有的锁，已持有的不受影响
+func (r *LockRegistry) SetLimit(limit int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limit = limit
+}
+
+// OnChange 设置锁被获取或释放时的回调，比如广播给所有客户端
+// 续租不会调用
+func (r *LockRegistry) OnChange(fn func(LockEvent)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = fn
+}
+
+// notify 在释放r.mu之后调用
+func (r *LockRegistry) notify(event string, reason string, leases ...*LockLease) {
+	r.mu.Lock()
+	fn := r.onChange
+	r.mu.Unlock()
+
+	if fn == nil {
+		return
+	}
+	for _, lease := range leases {
+		fn(LockEvent{Event: event, Reason: reason, Lease: lease})
+	}
+}
+
+// Acquire 获取锁，已由sess持有时续租(Acquired不变)
+// 被他人持有时返回的error包含ErrLockedByOther，超过每个用户的上限时返回ErrLockLimit
+func (r *LockRegistry) Acquire(key string, sess JwtSession, client *ws.Client, ttl time.Duration) (*LockLease, error) {
+	lease, renewed, err := r.acquire(key, sess, client, ttl)
+	if err == nil && !renewed {
+		r.notify(LockAcquired, "", lease)
+	}
+	return lease, err
+}
+
+func (r *LockRegistry) acquire(key string, sess JwtSession, client *ws.Client, ttl time.Duration) (lease *LockLease, renewed bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	userID := sess.UserID()
+	acquired := now
+	if entry, ok := r.byKey[key]; ok {
+		if entry.lease.UserID != userID {
+			return nil, false, fmt.Errorf("%w: %s", ErrLockedByOther, entry.lease)
+		}
+		acquired, renewed = entry.lease.Acquired, true
+		r.remove(key)
+	} else if r.limit > 0 && len(r.byUser[userID]) >= r.limit {
+		return nil, false, fmt.Errorf("%w: 最多%d个", ErrLockLimit, r.limit)
+	}
+
+	lease = NewLockLease(key, sess, acquired, now.Add(ttl))
+	entry := &lockEntry{lease: lease, client: client}
+	entry.timer = time.AfterFunc(ttl, func() { r.expire(key, lease) })
+
+	r.byKey[key] = entry
+	r.byUser[userID] = addKey(r.byUser[userID], key)
+	if client != nil {
+		r.byConn[client] = addKey(r.byConn[client], key)
+	}
+	return lease, renewed, nil
+}
+
+// Renew 只有持有者可以续租，未被持有(或已过期)时返回ErrLockNotHeld
+func (r *LockRegistry) Renew(key string, sess JwtSession, client *ws.Client, ttl time.Duration) (*LockLease, error) {
+	if lease := r.Get(key); lease == nil || lease.UserID != sess.UserID() {
+		return nil, fmt.Errorf("%w: %s", ErrLockNotHeld, key)
+	}
+	return r.Acquire(key, sess, client, ttl)
+}
+
+// Get 返回key当前的租约，未被持有返回nil
+func (r *LockRegistry) Get(key string) *LockLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.byKey[key]; ok {
+		return entry.lease
+	}
+	return nil
+}
+
+// Release 释放key，返回被释放的租约，未被持有返回nil
+func (r *LockRegistry) Release(key string) *LockLease {
+	lease, _ := r.release(key, ReleaseUnlock)
+	return lease
+}
+
+// ForceRelease 管理员强制释放，同时返回获取该锁的连接，用于通知原持有者
+func (r *LockRegistry) ForceRelease(key string) (*LockLease, *ws.Client) {
+	return r.release(key, ReleaseForced)
+}
+
+func (r *LockRegistry) release(key, reason string) (*LockLease, *ws.Client) {
+	r.mu.Lock()
+	var client *ws.Client
+	if entry, ok := r.byKey[key]; ok {
+		client = entry.client
+	}
+	lease := r.remove(key)
+	r.mu.Unlock()
+
+	if lease != nil {
+		r.notify(LockReleased, reason, lease)
+	}
+	return lease, client
+}
+
+// ReleaseUser 释放该用户持有的所有锁(比如登出)
+func (r *LockRegistry) ReleaseUser(userID uint) []*LockLease {
+	r.mu.Lock()
+	released := r.removeAll(r.byUser[userID])
+	r.mu.Unlock()
+
+	r.notify(LockReleased, ReleaseLogout, released...)
+	return released
+}
+
+// ReleaseClient 释放该连接获取的所有锁(连接断开)
+func (r *LockRegistry) ReleaseClient(client *ws.Client) []*LockLease {
+	r.mu.Lock()
+	released := r.removeAll(r.byConn[client])
+	r.mu.Unlock()
+
+	r.notify(LockReleased, ReleaseDisconnect, released...)
+	return released
+}
+
+// Inspect 该表当前的锁及获取锁的连接，tableName为空时返回所有表的，按key排序
+func (r *LockRegistry) Inspect(tableName string) []LockInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]LockInfo, 0, len(r.byKey))
+	for key, entry := range r.byKey {
+		if tableName != "" && !strings.HasPrefix(key, tableName+"/") {
+			continue
+		}
+		info := LockInfo{LockLease: entry.lease}
+		if entry.client != nil {
+			info.ConnID, info.ConnAddr = entry.client.ID, entry.client.Addr
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// TableLocks 该表当前的锁，按key排序
+func (r *LockRegistry) TableLocks(tableName string) []*LockLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := tableName + "/"
+	keys := make(map[string]struct{})
+	for key := range r.byKey {
+		if strings.HasPrefix(key, prefix) {
+			keys[key] = struct{}{}
+		}
+	}
+	return r.leases(keys)
+}
+
+// UserLocks 该用户持有的锁，按key排序
+func (r *LockRegistry) UserLocks(userID uint) []*LockLease {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leases(r.byUser[userID])
+}
+
+// CheckWrite 悲观锁表在修改、删除前检查锁
+// 未上锁或由sess持有时可以写，被他人持有时返回的error包含ErrLockedByOther
+func (r *LockRegistry) CheckWrite(tabler Tabler, sess JwtSession) error {
+	if r == nil {
+		return nil
+	}
+	lease := r.Get(LockKey(tabler.TableName(), tabler.Model().ID))
+	if lease == nil || (sess != nil && lease.UserID == sess.UserID()) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrLockedByOther, lease)
+}
+
+// expire 租约到期，如果已经续租则不处理
+func (r *LockRegistry) expire(key string, lease *LockLease) {
+	r.mu.Lock()
+	entry, ok := r.byKey[key]
+	expired := ok && entry.lease == lease
+	if expired {
+		r.remove(key)
+	}
+	r.mu.Unlock()
+
+	if expired {
+		r.notify(LockReleased, ReleaseExpired, lease)
+	}
+}
+
+func (r *LockRegistry) remove(key string) *LockLease {
+	entry, ok := r.byKey[key]
+	if !ok {
+		return nil
+	}
+	entry.timer.Stop()
+	delete(r.byKey, key)
+	if delete(r.byUser[entry.lease.UserID], key); len(r.byUser[entry.lease.UserID]) == 0 {
+		delete(r.byUser, entry.lease.UserID)
+	}
+	if entry.client != nil {
+		if delete(r.byConn[entry.client], key); len(r.byConn[entry.client]) == 0 {
+			delete(r.byConn, entry.client)
+		}
+	}
+	return entry.lease
+}
+
+func (r *LockRegistry) removeAll(keys map[string]struct{}) []*LockLease {
+	released := r.leases(keys)
+	for _, lease := range released {
+		r.remove(lease.Key)
+	}
+	return released
+}
+
+func (r *LockRegistry) leases(keys map[string]struct{}) []*LockLease {
+	leases := make([]*LockLease, 0, len(keys))
+	for key := range keys {
+		leases = append(leases, r.byKey[key].lease)
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Key < leases[j].Key })
+	return leases
+}
+
+func addKey(keys map[string]struct{}, key string) map[string]struct{} {
+	if keys == nil {
+		keys = make(map[string]struct{})
+	}
+	keys[key] = struct{}{}
+	return keys
+}
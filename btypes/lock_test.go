@@ -0,0 +1,135 @@
+package btypes_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type lockedTable struct {
+	btypes.VirtualTable
+}
+
+func (*lockedTable) TableName() string     { return "orders" }
+func (*lockedTable) PessimisticLock() bool { return true }
+
+func TestLockRegistry(t *testing.T) {
+	locks := btypes.NewLockRegistry(2)
+	holder, other := &roleSession{ID: 1}, &roleSession{ID: 2}
+	tab1, tab2 := &ws.Client{}, &ws.Client{}
+
+	first, err := locks.Acquire("orders/1", holder, tab1, time.Minute)
+	require.NoError(t, err)
+	_, err = locks.Acquire("orders/2", holder, tab2, time.Minute)
+	require.NoError(t, err)
+
+	// 每个用户最多2个
+	_, err = locks.Acquire("orders/3", holder, tab1, time.Minute)
+	assert.True(t, errors.Is(err, btypes.ErrLockLimit))
+	// 他人持有
+	_, err = locks.Acquire("orders/1", other, nil, time.Minute)
+	assert.True(t, errors.Is(err, btypes.ErrLockedByOther))
+	_, err = locks.Renew("orders/1", other, nil, time.Minute)
+	assert.True(t, errors.Is(err, btypes.ErrLockNotHeld))
+
+	// 续租不改变Acquired，产生新的租约
+	renewed, err := locks.Renew("orders/1", holder, tab1, 2*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, first.Acquired, renewed.Acquired)
+	assert.True(t, renewed.Expires.After(first.Expires))
+	assert.Len(t, locks.UserLocks(1), 2)
+
+	// 连接断开只释放该连接获取的锁
+	released := locks.ReleaseClient(tab1)
+	require.Len(t, released, 1)
+	assert.Equal(t, "orders/1", released[0].Key)
+	assert.Nil(t, locks.Get("orders/1"))
+	assert.NotNil(t, locks.Get("orders/2"))
+
+	assert.Len(t, locks.ReleaseUser(1), 1)
+	assert.Empty(t, locks.UserLocks(1))
+}
+
+func TestLockRegistryExpire(t *testing.T) {
+	locks := btypes.NewLockRegistry(0)
+	_, err := locks.Acquire("orders/1", &roleSession{ID: 1}, nil, 20*time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return locks.Get("orders/1") == nil }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, locks.UserLocks(1))
+}
+
+func TestCheckWrite(t *testing.T) {
+	locks := btypes.NewLockRegistry(0)
+	table := &lockedTable{}
+	table.ID = 3
+	holder, other := &roleSession{ID: 1}, &roleSession{ID: 2}
+
+	// 未上锁时都可以写
+	assert.NoError(t, locks.CheckWrite(table, other))
+
+	_, err := locks.Acquire(btypes.LockKey("orders", 3), holder, nil, time.Minute)
+	require.NoError(t, err)
+
+	assert.NoError(t, locks.CheckWrite(table, holder))
+	err = locks.CheckWrite(table, other)
+	assert.True(t, errors.Is(err, btypes.ErrLockedByOther))
+	assert.Contains(t, err.Error(), "orders/3")
+	assert.True(t, errors.Is(locks.CheckWrite(table, nil), btypes.ErrLockedByOther))
+}
+
+func TestLockRegistryOnChange(t *testing.T) {
+	locks := btypes.NewLockRegistry(0)
+	var events []btypes.LockEvent
+	locks.OnChange(func(e btypes.LockEvent) { events = append(events, e) })
+
+	holder := &roleSession{ID: 1}
+	_, err := locks.Acquire("orders/1", holder, nil, time.Minute)
+	require.NoError(t, err)
+	// 续租不通知
+	_, err = locks.Renew("orders/1", holder, nil, time.Minute)
+	require.NoError(t, err)
+	_, err = locks.Acquire("orders/2", holder, nil, time.Minute)
+	require.NoError(t, err)
+
+	assert.Len(t, locks.TableLocks("orders"), 2)
+	assert.Empty(t, locks.TableLocks("order"))
+
+	locks.Release("orders/1")
+	locks.ReleaseUser(1)
+
+	require.Len(t, events, 4)
+	assert.Equal(t, btypes.LockAcquired, events[0].Event)
+	assert.Equal(t, "orders/1", events[0].Lease.Key)
+	assert.Equal(t, "orders", events[0].Lease.TableName())
+	assert.Equal(t, btypes.LockAcquired, events[1].Event)
+	assert.Equal(t, btypes.LockEvent{Event: btypes.LockReleased, Reason: btypes.ReleaseUnlock, Lease: events[2].Lease}, events[2])
+	assert.Equal(t, btypes.ReleaseLogout, events[3].Reason)
+	assert.Equal(t, "orders/2", events[3].Lease.Key)
+}
+
+func TestLockRegistryInspect(t *testing.T) {
+	locks := btypes.NewLockRegistry(0)
+	client := &ws.Client{ID: 7, Addr: "10.0.0.1:5000"}
+	_, err := locks.Acquire("orders/1", &roleSession{ID: 1}, client, time.Minute)
+	require.NoError(t, err)
+	_, err = locks.Acquire("users/1", &roleSession{ID: 2}, nil, time.Minute)
+	require.NoError(t, err)
+
+	infos := locks.Inspect("orders")
+	require.Len(t, infos, 1)
+	assert.Equal(t, uint(1), infos[0].UserID)
+	assert.Equal(t, uint64(7), infos[0].ConnID)
+	assert.Equal(t, "10.0.0.1:5000", infos[0].ConnAddr)
+	assert.Len(t, locks.Inspect(""), 2)
+
+	lease, holder := locks.ForceRelease("orders/1")
+	require.NotNil(t, lease)
+	assert.Same(t, client, holder)
+	assert.Nil(t, locks.Get("orders/1"))
+}
@@ -74,8 +74,14 @@ type QueryParam struct {
 	Orderby string   `json:"orderby,omitempty"`
 	//! 需要客户端协调
 	ForceUpdated bool `json:"force_updated,omitempty"` // 强制刷新，查询数据库
+
+	// 行级安全的范围，由服务端在Call时设置在该请求的副本上
+	scope *RowScope
 }
 
+// RowScope 该查询的行级安全范围，自定义Query时需要加上，可能为nil
+func (qp *QueryParam) RowScope() *RowScope { return qp.scope }
+
 func (qp *QueryParam) String() string        { return "Flow @Query" }
 func (qp *QueryParam) ReadForceUpdate() bool { return qp.ForceUpdated }
 func (qp *QueryParam) Status() RequestStatus { return StatusRead }
@@ -135,8 +141,64 @@ func (qp *QueryParam) BuildCacheKey(reqType string) string {
 	return fmt.Sprintf("%X", hasher.Sum(nil))
 }
 
+// ScopedRequestType 如果tabler实现了RowScoper或SessionScoper，就把session的范围加入请求类型，再用于计算缓存键
+// 缓存仍然按表名分桶，所以清除该表缓存时，所有范围的缓存都会被清除
+func ScopedRequestType(tabler Tabler, sess JwtSession, reqType string) string {
+	if scope := RowScopeOf(tabler, sess); scope != nil {
+		reqType += "#" + scope.String()
+	}
+	scoper, ok := tabler.(SessionScoper)
+	if !ok {
+		return reqType
+	}
+	return reqType + "@" + SessionScope(sess, scoper.ScopeFields())
+}
+
+// CheckScopeFields 检查tablers的ScopeFields都是sess的字段
+// 在启动时调用，SessionScope在请求时就不会因字段不存在而panic
+func CheckScopeFields(sess JwtSession, tablers ...Tabler) error {
+	values := Struct2Map(sess.New())
+	for _, tabler := range tablers {
+		scoper, ok := tabler.(SessionScoper)
+		if !ok {
+			continue
+		}
+		for _, field := range scoper.ScopeFields() {
+			if _, ok := values[field]; !ok {
+				return fmt.Errorf("%s 的ScopeFields %q 不是JwtSession的字段", tabler.TableName(), field)
+			}
+		}
+	}
+	return nil
+}
+
+// SessionScope 将sess中fields对应的值拼接起来，sess为nil时代表匿名范围
+// fields应已由CheckScopeFields检查过
+func SessionScope(sess JwtSession, fields []string) string {
+	if sess == nil {
+		return ""
+	}
+	values := Struct2Map(sess)
+
+	var builder strings.Builder
+	for _, field := range fields {
+		value, ok := values[field]
+		if !ok {
+			panic(fmt.Sprintf("JwtSession 没有字段%q，不能作为缓存范围", field))
+		}
+		builder.WriteString(field)
+		builder.WriteByte('=')
+		builder.WriteString(fmt.Sprint(value))
+		builder.WriteByte(';')
+	}
+	return builder.String()
+}
+
+// Call Parameter在请求间共用，范围只设置在该请求的副本上
 func (qp *QueryParam) Call(c *Context, tabler Tabler) (Result, error) {
-	return tabler.Query(c, tabler, qp, c.JwtSess)
+	query := *qp
+	query.scope = RowScopeOf(tabler, c.JwtSess)
+	return tabler.Query(c, tabler, &query, c.JwtSess)
 }
 
 // -------------------------WriterParam---------------------------------
@@ -165,6 +227,34 @@ func (wp *WriterParameter) JwtCheck() bool              { return wp.CheckJWT }
 func (wp *WriterParameter) ReadForceUpdate() bool       { return false }
 
 func (wp *WriterParameter) Call(c *Context, tabler Tabler) (Result, error) {
+	c.DB = c.DB.WithRowScope(RowScopeOf(tabler, c.JwtSess))
+
+	// 插入时由服务端设置所有者，不信任客户端传来的值
+	if owner, ok := tabler.(RowOwner); ok && wp.ParamType == ParamInsert && c.JwtSess != nil {
+		owner.SetRowOwner(c.JwtSess)
+	}
+
+	// 除插入外的写操作都要检查悲观锁
+	if wp.ParamType != ParamInsert && tabler.PessimisticLock() {
+		if err := c.Locks.CheckWrite(tabler, c.JwtSess); err != nil {
+			c.Logger.Warnf("%s %s", wp.ParamType, err)
+			return Result{}, err
+		}
+	}
+
+	// 开启了RowLocker的表，修改及删除在锁住该行的事务中进行
+	if wp.ParamType != ParamInsert && rowLocked(tabler) {
+		return c.WithRowLock(tabler, func(current Tabler) (Result, error) {
+			if updater, ok := tabler.(RowLockUpdater); ok && wp.ParamType == ParamUpdate {
+				return updater.UpdateLocked(c, current, tabler, c.JwtSess)
+			}
+			return wp.call(c, tabler)
+		})
+	}
+	return wp.call(c, tabler)
+}
+
+func (wp *WriterParameter) call(c *Context, tabler Tabler) (Result, error) {
 	switch wp.ParamType {
 	case ParamInsert:
 		return tabler.Insert(c, tabler, c.JwtSess)
@@ -80,3 +80,47 @@ func TestWriterParameter(t *testing.T) {
 	assert.Panics(t, func() { wp.BuildCacheKey("") })
 	assert.Equal(t, wp.Status(), btypes.StatusWrite)
 }
+
+type scopedSession struct {
+	ID   uint   `json:"id"`
+	Role string `json:"role"`
+}
+
+func (*scopedSession) New() btypes.JwtSession { return &scopedSession{} }
+func (s *scopedSession) UserID() uint         { return s.ID }
+
+type scopedTable struct {
+	btypes.VirtualTable
+}
+
+func (*scopedTable) ScopeFields() []string { return []string{"id"} }
+
+func TestScopedCacheKey(t *testing.T) {
+	qp := &btypes.QueryParam{Size: 20, Orderby: "updated_at DESC"}
+	userA := &scopedSession{ID: 1, Role: "admin"}
+	userB := &scopedSession{ID: 2, Role: "admin"}
+
+	// 没有实现SessionScoper的表，不区分用户
+	plain := &btypes.VirtualTable{}
+	assert.Equal(t,
+		qp.BuildCacheKey(btypes.ScopedRequestType(plain, userA, "order/query")),
+		qp.BuildCacheKey(btypes.ScopedRequestType(plain, userB, "order/query")))
+
+	scoped := &scopedTable{}
+	keyA := qp.BuildCacheKey(btypes.ScopedRequestType(scoped, userA, "order/query"))
+	keyB := qp.BuildCacheKey(btypes.ScopedRequestType(scoped, userB, "order/query"))
+	assert.NotEqual(t, keyA, keyB)
+	assert.Equal(t, keyA, qp.BuildCacheKey(btypes.ScopedRequestType(scoped, &scopedSession{ID: 1}, "order/query")))
+
+	assert.Panics(t, func() { btypes.SessionScope(userA, []string{"not_exist"}) })
+
+	// 启动时检查ScopeFields
+	assert.NoError(t, btypes.CheckScopeFields(&scopedSession{}, plain, scoped))
+	assert.Error(t, btypes.CheckScopeFields(&scopedSession{}, plain, &tenantTable{}))
+}
+
+type tenantTable struct {
+	btypes.VirtualTable
+}
+
+func (*tenantTable) ScopeFields() []string { return []string{"tenant_id"} }
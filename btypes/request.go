@@ -3,6 +3,7 @@ package btypes
 import (
 	"encoding/json"
 	"io"
+	"strings"
 )
 
 // *********************************************************************
@@ -12,6 +13,28 @@ type Request struct {
 	Payload json.RawMessage `json:"payload,omitempty"`
 	UUID    string          `json:"uuid,omitempty"`
 	Token   string          `json:"token,omitempty"`
+	// ETag 客户端上次查询得到的内容hash，如果数据没有变化，就返回not_modified
+	// http请求时是If-None-Match，可以是W/"..."或逗号分隔的列表
+	ETag string `json:"etag,omitempty"`
+}
+
+// ETagMatches 客户端带来的ETag是否与etag一致
+// 按If-None-Match的弱比较: 忽略W/前缀，列表中任一个一致即可，*匹配任意
+func (req *Request) ETagMatches(etag string) bool {
+	if etag == "" || req.ETag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(req.ETag, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`)
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
 }
 
 // FromHttpRequest
@@ -0,0 +1,28 @@
+package btypes_test
+
+import (
+	"testing"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequest_ETagMatches(t *testing.T) {
+	cases := []struct {
+		header string
+		match  bool
+	}{
+		{"", false},
+		{"ABC", true},
+		{`"ABC"`, true},
+		{`W/"ABC"`, true},
+		{`"XYZ", W/"ABC"`, true},
+		{`"XYZ", "DEF"`, false},
+		{"*", true},
+	}
+	for _, tc := range cases {
+		req := &btypes.Request{ETag: tc.header}
+		assert.Equal(t, tc.match, req.ETagMatches("ABC"), tc.header)
+	}
+	assert.False(t, (&btypes.Request{ETag: "*"}).ETagMatches(""))
+}
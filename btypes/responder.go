@@ -2,7 +2,10 @@ package btypes
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -17,6 +20,9 @@ type Responder interface {
 	Broadcast() bool
 	RemoveUUID()
 	Silence()
+	// ETag 是payload的内容hash，客户端可以在下次请求时带上，数据未改变就不再传输payload
+	SetETag(string)
+	EntityTag() string
 }
 
 // ResponderToReader 代表将Responder转化为io.Reader
@@ -30,6 +36,7 @@ type Response struct {
 	Type      string                 `json:"type,omitempty"`
 	Payload   map[string]interface{} `json:"payload"` // payload就是没值也要有{}
 	UUID      string                 `json:"uuid,omitempty"`
+	ETag      string                 `json:"etag,omitempty"`
 	broadcast bool
 }
 
@@ -73,6 +80,9 @@ func (resp *Response) Silence() {
 	resp.Add(Pair{Key: "silence", Value: true})
 }
 
+func (resp *Response) SetETag(etag string) { resp.ETag = etag }
+func (resp *Response) EntityTag() string   { return resp.ETag }
+
 // BuildFromRequest 从req，success构建
 func BuildFromRequest(responseType ConfigResponseType, req *Request, success, broadcast bool) *Response {
 	resp := &Response{}
@@ -89,7 +99,12 @@ func BuildErrorResposeFromRequest(responseType ConfigResponseType, req *Request,
 
 	resp.Type = responseType(req.Type, false)
 	resp.UUID = req.UUID
-	resp.Payload = map[string]interface{}{"err": err.Error()}
+	payload := map[string]interface{}{"err": err.Error()}
+	var locked *LockedError
+	if errors.As(err, &locked) {
+		payload["retry_after"] = locked.RetryAfterSeconds()
+	}
+	resp.Payload = payload
 	resp.broadcast = false
 	return resp
 }
@@ -100,6 +115,9 @@ type RawResponse struct {
 	Type    string          `json:"type,omitempty"`
 	Payload json.RawMessage `json:"payload"` // payload就是没值也要有{}
 	UUID    string          `json:"uuid,omitempty"`
+	ETag    string          `json:"etag,omitempty"`
+	// notModified 由NewNotModifiedResponse构建，http应答304
+	notModified bool
 }
 
 func NewRawResponseText(crt ConfigResponseType, req_type, uuid string, data []byte) *RawResponse {
@@ -114,6 +132,25 @@ func NewRawResponse(crt ConfigResponseType, req *Request, data []byte) *RawRespo
 	return NewRawResponseText(crt, req.Type, req.UUID, data)
 }
 
+// NewNotModifiedResponse 客户端带来的ETag与当前数据一致，只返回一个很小的应答
+func NewNotModifiedResponse(crt ConfigResponseType, req *Request, etag string) *RawResponse {
+	rr := NewRawResponse(crt, req, []byte(`{"not_modified":true}`))
+	rr.ETag = etag
+	rr.notModified = true
+	return rr
+}
+
+// IsNotModified resp是否是NewNotModifiedResponse构建的应答
+func IsNotModified(resp Responder) bool {
+	rr, ok := resp.(*RawResponse)
+	return ok && rr.notModified
+}
+
+// PayloadETag 计算payload的内容hash
+func PayloadETag(payload []byte) string {
+	return fmt.Sprintf("%X", md5.Sum(payload))
+}
+
 // JSON 实现Responser
 func (rr *RawResponse) JSON() []byte {
 	data, err := json.Marshal(rr)
@@ -126,6 +163,8 @@ func (rr *RawResponse) JSON() []byte {
 func (rr *RawResponse) JSONPayload() []byte { return rr.Payload }
 func (rr *RawResponse) Broadcast() bool     { return false }
 func (rr *RawResponse) RemoveUUID()         { rr.UUID = "" }
+func (rr *RawResponse) SetETag(etag string) { rr.ETag = etag }
+func (rr *RawResponse) EntityTag() string   { return rr.ETag }
 func (rr *RawResponse) Silence() {
 	var buf bytes.Buffer
 
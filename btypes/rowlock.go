@@ -0,0 +1,68 @@
+package btypes
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RowLocker 代表该表的修改及删除在事务中先以 SELECT ... FOR UPDATE 锁住该行
+// 适合计数器、库存等读-改-写的短临界区，与version乐观锁同时生效
+type RowLocker interface {
+	LockRowForUpdate() bool
+}
+
+// RowLockUpdater 可选，开启了RowLocker的表修改时代替Update，current是锁住后读出的当前数据
+// 用于以当前值计算新值，比如 tabler.Stock = current.Stock - tabler.Quantity
+// 在同一事务中调用，c.DB是该事务，返回error或panic时回滚
+// version仍然生效: tabler.Version与current不一致时UpdateWithOmits返回ErrOptimisticLock
+type RowLockUpdater interface {
+	UpdateLocked(c *Context, current, tabler Tabler, jwtSess JwtSession) (Result, error)
+}
+
+// WithRowLock 在事务中锁住tabler对应的行，再执行fn
+// fn中的c.DB是该事务，current是锁住后读出的当前数据，可以据此计算新值
+// fn返回error或panic时回滚
+// sqlite不支持FOR UPDATE(其写事务本身是串行的)，sqlserver需要表提示，这两种只使用事务
+func (c *Context) WithRowLock(tabler Tabler, fn func(current Tabler) (Result, error)) (result Result, err error) {
+	saved := c.DB
+	defer func() { c.DB = saved }()
+
+	err = saved.Gorm.Transaction(func(tx *gorm.DB) error {
+		current := tabler.New()
+		query := tx.Model(current).Where("id = ?", tabler.Model().ID)
+		if saved.scope != nil {
+			query = query.Where(saved.scope.Query, saved.scope.Args...)
+		}
+		if supportsForUpdate(tx) {
+			query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+		}
+		if err := query.First(current).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+
+		c.DB = &DB{Gorm: tx, scope: saved.scope}
+		var err error
+		result, err = fn(current)
+		return err
+	})
+	return
+}
+
+func supportsForUpdate(db *gorm.DB) bool {
+	switch db.Dialector.Name() {
+	case "sqlite", "sqlserver":
+		return false
+	}
+	return true
+}
+
+// rowLocked 该表开启了RowLocker
+func rowLocked(tabler Tabler) bool {
+	locker, ok := tabler.(RowLocker)
+	return ok && locker.LockRowForUpdate()
+}
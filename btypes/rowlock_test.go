@@ -0,0 +1,214 @@
+package btypes_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// counterRow 内存中的counters表，只有一行
+type counterRow struct {
+	version int64
+	value   int64
+}
+
+// fakeDB 只理解WithRowLock及UpdateWithOmits产生的SQL，记录执行的语句
+// 事务中的修改在COMMIT时才生效
+type fakeDB struct {
+	mu    sync.Mutex
+	row   counterRow
+	stmts []string
+}
+
+func (db *fakeDB) log(stmt string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.stmts = append(db.stmts, stmt)
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct {
+	db      *fakeDB
+	pending *counterRow
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.log("BEGIN")
+	c.db.mu.Lock()
+	row := c.db.row
+	c.db.mu.Unlock()
+	c.pending = &row
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.log("COMMIT")
+	c.db.mu.Lock()
+	c.db.row = *c.pending
+	c.db.mu.Unlock()
+	c.pending = nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.log("ROLLBACK")
+	c.pending = nil
+	return nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.log(query)
+	row := c.pending
+	if row == nil || args[len(args)-1].Value != int64(1) {
+		return &fakeRows{}, nil
+	}
+	if strings.Contains(query, "version = ?") && args[0].Value != row.version {
+		return &fakeRows{}, nil
+	}
+	now := time.Now()
+	return &fakeRows{values: [][]driver.Value{{int64(1), now, now, nil, row.version, row.value}}}, nil
+}
+
+// ExecContext UPDATE `counters` SET `a`=?,... WHERE version = ? AND ... `id` = ?
+// 该行已存在，INSERT都违反主键约束
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.log(query)
+	if !strings.HasPrefix(query, "UPDATE ") {
+		return nil, errors.New("UNIQUE constraint failed: counters.id")
+	}
+	parts := strings.SplitN(query, " WHERE ", 2)
+	columns := strings.Split(strings.TrimPrefix(parts[0], "UPDATE `counters` SET "), ",")
+	where := args[len(columns):]
+	if c.pending == nil || where[0].Value != c.pending.version || where[len(where)-1].Value != int64(1) {
+		return driver.RowsAffected(0), nil
+	}
+	for i, column := range columns {
+		switch column {
+		case "`version`=?":
+			c.pending.version = args[i].Value.(int64)
+		case "`value`=?":
+			c.pending.value = args[i].Value.(int64)
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (*fakeRows) Columns() []string {
+	return []string{"id", "created_at", "updated_at", "deleted_at", "version", "value"}
+}
+func (*fakeRows) Close() error { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// fakeDialector 支持FOR UPDATE的方言
+type fakeDialector struct{ db *fakeDB }
+
+func (fakeDialector) Name() string { return "fake" }
+func (d fakeDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = sql.OpenDB(d.db)
+	return nil
+}
+func (fakeDialector) Migrator(*gorm.DB) gorm.Migrator { return nil }
+func (fakeDialector) DataTypeOf(*schema.Field) string { return "" }
+func (fakeDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+func (fakeDialector) BindVarTo(w clause.Writer, _ *gorm.Statement, _ interface{}) { w.WriteByte('?') }
+func (fakeDialector) QuoteTo(w clause.Writer, str string) {
+	w.WriteByte('`')
+	w.WriteString(str)
+	w.WriteByte('`')
+}
+func (fakeDialector) Explain(sql string, vars ...interface{}) string {
+	return gormlogger.ExplainSQL(sql, nil, `'`, vars...)
+}
+
+var errInsufficient = errors.New("余额不足")
+
+// counter 修改时以锁住的当前值加上Delta
+type counter struct {
+	btypes.GormModel
+	Value int64
+	Delta int64 `gorm:"-"`
+}
+
+func (*counter) New() btypes.Tabler                       { return &counter{} }
+func (*counter) TableName() string                        { return "counters" }
+func (*counter) Register(map[string]btypes.ContextConfig) {}
+func (*counter) LockRowForUpdate() bool                   { return true }
+func (*counter) UpdateLocked(c *btypes.Context, current, tabler btypes.Tabler, _ btypes.JwtSession) (btypes.Result, error) {
+	cur, next := current.(*counter), tabler.(*counter)
+	if cur.Value+next.Delta < 0 {
+		return btypes.Result{}, errInsufficient
+	}
+	next.Value = cur.Value + next.Delta
+	return btypes.Result{}, next.UpdateWithOmits(c.DB, next, "created_at")
+}
+
+func TestWriterRowLock(t *testing.T) {
+	fake := &fakeDB{row: counterRow{version: 1, value: 10}}
+	gdb, err := gorm.Open(fakeDialector{db: fake}, &gorm.Config{Logger: gormlogger.Discard})
+	require.NoError(t, err)
+
+	update := func(version uint, delta int64) error {
+		c := &btypes.Context{DB: &btypes.DB{Gorm: gdb}, Logger: logger.MultiTargets{}}
+		tabler := &counter{Delta: delta}
+		tabler.ID, tabler.Version = 1, version
+
+		fake.stmts = nil
+		_, err := (&btypes.WriterParameter{ParamType: btypes.ParamUpdate}).Call(c, tabler)
+		// 事务结束后恢复原来的DB
+		assert.Same(t, gdb, c.DB.Gorm)
+		return err
+	}
+
+	// 在锁住该行的事务中以当前值计算
+	require.NoError(t, update(1, -3))
+	require.Len(t, fake.stmts, 4)
+	assert.Equal(t, "BEGIN", fake.stmts[0])
+	assert.True(t, strings.HasSuffix(fake.stmts[1], "FOR UPDATE"), fake.stmts[1])
+	assert.True(t, strings.HasPrefix(fake.stmts[2], "UPDATE `counters` SET"), fake.stmts[2])
+	assert.Equal(t, "COMMIT", fake.stmts[3])
+	assert.Equal(t, counterRow{version: 2, value: 7}, fake.row)
+
+	// UpdateLocked返回error时回滚
+	assert.True(t, errors.Is(update(2, -8), errInsufficient))
+	assert.Equal(t, "ROLLBACK", fake.stmts[len(fake.stmts)-1])
+	assert.Equal(t, counterRow{version: 2, value: 7}, fake.row)
+
+	// version不一致时仍是乐观锁错误，并回滚
+	assert.True(t, errors.Is(update(1, 1), btypes.ErrOptimisticLock))
+	assert.Equal(t, "ROLLBACK", fake.stmts[len(fake.stmts)-1])
+	assert.Equal(t, counterRow{version: 2, value: 7}, fake.row)
+}
@@ -0,0 +1,38 @@
+package btypes
+
+import "fmt"
+
+// RowScope 代表行级安全的范围条件，比如 {"owner_id = ?", []interface{}{sess.UserID()}}
+type RowScope struct {
+	Query string
+	Args  []interface{}
+}
+
+func (rs *RowScope) String() string { return fmt.Sprintf("%s %v", rs.Query, rs.Args) }
+
+// RowScoper 代表Tabler只允许用户看到并修改自己范围内的数据
+// QueryAssist(包括统计总数)、UpdateWithOmits及删除时会自动加上该条件，插入后检查是否在范围内
+// 修改或删除范围外的数据会返回ErrRecordNotFound
+type RowScoper interface {
+	RowScope(JwtSession) RowScope
+}
+
+// RowOwner 代表插入时由服务端设置数据的所有者，比如 owner_id = sess.UserID()
+// 插入后的数据仍需在RowScope范围内，否则回滚并返回ErrForbidden
+type RowOwner interface {
+	SetRowOwner(JwtSession)
+}
+
+// RowScopeOf 如果tabler实现了RowScoper，返回sess对应的范围，否则返回nil
+// 没有session时(比如DefaultPush)范围为空集
+func RowScopeOf(tabler Tabler, sess JwtSession) *RowScope {
+	scoper, ok := tabler.(RowScoper)
+	if !ok {
+		return nil
+	}
+	if sess == nil {
+		return &RowScope{Query: "1 = 0"}
+	}
+	scope := scoper.RowScope(sess)
+	return &scope
+}
@@ -0,0 +1,50 @@
+package btypes_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/stretchr/testify/assert"
+)
+
+type ownedTable struct {
+	btypes.VirtualTable
+}
+
+func (*ownedTable) TableName() string { return "notes" }
+func (*ownedTable) RowScope(sess btypes.JwtSession) btypes.RowScope {
+	return btypes.RowScope{Query: "owner_id = ?", Args: []interface{}{sess.UserID()}}
+}
+
+// Query 返回该请求看到的范围，中间让出CPU，使并发的请求交错
+func (*ownedTable) Query(c *btypes.Context, _ btypes.Tabler, qp *btypes.QueryParam, _ btypes.JwtSession) (result btypes.Result, err error) {
+	before := qp.RowScope().String()
+	time.Sleep(time.Millisecond)
+	result.Payloads.Add("scope", before+"|"+qp.RowScope().String())
+	return
+}
+
+func TestQueryParamScopePerRequest(t *testing.T) {
+	// 与HandlerFunc一样，所有请求共用一个Parameter
+	shared := &btypes.QueryParameter{}
+	tabler := &ownedTable{}
+
+	var wg sync.WaitGroup
+	for _, id := range []uint{1, 2} {
+		wg.Add(1)
+		go func(id uint) {
+			defer wg.Done()
+			want := fmt.Sprintf("owner_id = ? [%d]", id)
+			for i := 0; i < 50; i++ {
+				c := &btypes.Context{JwtSess: &roleSession{ID: id}}
+				result, err := shared.Call(c, tabler)
+				assert.NoError(t, err)
+				assert.Equal(t, want+"|"+want, result.Payloads[0].Value)
+			}
+		}(id)
+	}
+	wg.Wait()
+}
@@ -51,6 +51,13 @@ func (*VirtualTable) New() Tabler                       { return &VirtualTable{}
 func (*VirtualTable) TableName() string                 { return "" }
 func (*VirtualTable) Register(map[string]ContextConfig) {}
 
+// SessionScoper 代表该表的查询结果依赖于JwtSession的某些字段(比如"我的订单")
+// ScopeFields 返回这些字段名(与Struct2Map的键一致)，其值会加入缓存键，不同用户的缓存不会串用
+// 需用Manager.Session设置JwtSession，启动时检查这些字段是否存在
+type SessionScoper interface {
+	ScopeFields() []string
+}
+
 type Connectter interface {
 	Push(*DB, Cacher, logger.Logger, ConfigResponseType) Responder
 }
@@ -58,22 +65,30 @@ type Connectter interface {
 func DefaultPush(db *DB, cacher Cacher, log logger.Logger, crt ConfigResponseType,
 	tabler Tabler, action string) Responder {
 
-	tableName := tabler.TableName()
 	qp := QueryParam{
 		Size:    int64(tabler.Size()),
 		Orderby: tabler.Orderby(),
 	}
+	return PushQuery(db, cacher, log, crt, tabler, tabler.TableName()+"/"+action, qp)
+}
+
+// PushQuery 以request_type及qp查询tabler，优先使用缓存，未命中则查询数据库并设置缓存
+func PushQuery(db *DB, cacher Cacher, log logger.Logger, crt ConfigResponseType,
+	tabler Tabler, request_type string, qp QueryParam) Responder {
+
+	tableName := tabler.TableName()
 	ctx := Context{DB: db, Cacher: cacher, Logger: log, ConfigResponseType: crt}
-	request_type := tableName + "/" + action
-	key := qp.BuildCacheKey(request_type)
+	key := qp.BuildCacheKey(ScopedRequestType(tabler, nil, request_type))
 
 	bin := cacher.GetBucket(tableName, key)
 	if bin != nil {
 		rb := NewRawResponseText(crt, request_type, "", bin)
+		rb.SetETag(PayloadETag(bin))
 		log.Infof("Use Cache: %s", string(rb.JSON()))
 		return rb
 	}
 
+	qp.scope = RowScopeOf(tabler, nil)
 	result, err := tabler.Query(&ctx, tabler, &qp, nil)
 	if err != nil {
 		panic(err)
@@ -86,7 +101,9 @@ func DefaultPush(db *DB, cacher Cacher, log logger.Logger, crt ConfigResponseTyp
 	resp.Add(result.Payloads...)
 
 	// 设置缓存
-	cacher.SetBucket(tableName, key, resp.JSONPayload())
+	payload := resp.JSONPayload()
+	cacher.SetBucket(tableName, key, payload)
+	resp.SetETag(PayloadETag(payload))
 	log.Infof("Push => Query Database & Set Cache: %s", string(resp.JSON()))
 	return resp
 }
@@ -47,17 +47,26 @@ func QueryAssist(db *gorm.DB, tabler Tabler, queryParam *QueryParam, total *int6
 
 	tx = tx.Table(tableName)
 
+	// 行级安全的范围，查询及统计都要加上
+	var scopeSQL string
+	var scopeArgs []interface{}
+	if scope := queryParam.scope; scope != nil {
+		scopeSQL = fmt.Sprintf(" AND (%s)", scope.Query)
+		scopeArgs = scope.Args
+		tx = tx.Where(scope.Query, scope.Args...)
+	}
+
 	// 所有where合在一起的从句
 	var conditions string
 	if len(queryParam.Conds) > 0 {
 		conditions = strings.Join(queryParam.Conds, " AND ")
 		tx = tx.Where(conditions)
-		if err := tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE deleted_at IS NULL AND %s", tableName, conditions)).Scan(total).Error; err != nil {
+		if err := tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE deleted_at IS NULL AND %s%s", tableName, conditions, scopeSQL), scopeArgs...).Scan(total).Error; err != nil {
 			tx.Rollback()
 			panic(err)
 		}
 	} else {
-		if err := tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE deleted_at IS NULL", tableName)).Scan(total).Error; err != nil {
+		if err := tx.Raw(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE deleted_at IS NULL%s", tableName, scopeSQL), scopeArgs...).Scan(total).Error; err != nil {
 			tx.Rollback()
 			panic(err)
 		}
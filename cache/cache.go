@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"sync"
 	"time"
 
 	"github.com/bluele/gcache"
@@ -14,19 +15,39 @@ const (
 	cacheSize = 1024
 )
 
-var _ btypes.Cacher = (*Cache)(nil)
+var (
+	_ btypes.Cacher        = (*Cache)(nil)
+	_ btypes.ExpireCacher  = (*Cache)(nil)
+	_ btypes.Incrementer   = (*Cache)(nil)
+	_ btypes.DurableCacher = (*Cache)(nil)
+)
 
+// Cache 普通的值在容量为cacheSize的ARC中，满了会被淘汰
+// SetDurable及Increment的值保存在durable中，只在过期后删除
 type Cache struct {
 	*ccache.LayeredCache
 	gcache.Cache
 	logger logger.Logger
+
+	durableMu sync.Mutex
+	durable   map[interface{}]durableItem
+	// durable达到该大小时清理一次过期的值
+	sweepAt int
+}
+
+// durableItem expires为零值时不过期
+type durableItem struct {
+	value   interface{}
+	expires time.Time
 }
 
 func New(logger logger.Logger) *Cache {
 	return &Cache{
-		ccache.Layered(ccache.Configure()),
-		gcache.New(cacheSize).ARC().Expiration(expire).Build(),
-		logger,
+		LayeredCache: ccache.Layered(ccache.Configure()),
+		Cache:        gcache.New(cacheSize).ARC().Expiration(expire).Build(),
+		logger:       logger,
+		durable:      make(map[interface{}]durableItem),
+		sweepAt:      cacheSize,
 	}
 }
 
@@ -54,6 +75,7 @@ func (c *Cache) ClearBuckets(tableNames ...string) {
 }
 
 func (c *Cache) Set(key, value interface{}) {
+	c.removeDurable(key)
 	err := c.Cache.Set(key, value)
 	if err != nil {
 		c.logger.Errorf("Set %v:%v failed: %v", key, value, err)
@@ -61,7 +83,43 @@ func (c *Cache) Set(key, value interface{}) {
 	}
 }
 
+func (c *Cache) SetWithExpire(key, value interface{}, expiration time.Duration) {
+	c.removeDurable(key)
+	err := c.Cache.SetWithExpire(key, value, expiration)
+	if err != nil {
+		c.logger.Errorf("SetWithExpire %v:%v failed: %v", key, value, err)
+		panic("Cache SetWithExpire(key, value, expiration) failed")
+	}
+}
+
+func (c *Cache) SetDurable(key, value interface{}, ttl time.Duration) {
+	c.durableMu.Lock()
+	defer c.durableMu.Unlock()
+	c.setDurable(key, value, ttl)
+}
+
+// Increment 计数与SetDurable一样不会被淘汰
+func (c *Cache) Increment(key interface{}, ttl time.Duration) int64 {
+	c.durableMu.Lock()
+	defer c.durableMu.Unlock()
+
+	var n int64
+	if v, ok := c.getDurable(key); ok {
+		n = v.(int64)
+	}
+	n++
+	c.setDurable(key, n, ttl)
+	return n
+}
+
 func (c *Cache) Get(key interface{}) (interface{}, bool) {
+	c.durableMu.Lock()
+	v, ok := c.getDurable(key)
+	c.durableMu.Unlock()
+	if ok {
+		return v, true
+	}
+
 	v, err := c.Cache.Get(key)
 	if err != nil {
 		return nil, false
@@ -70,5 +128,51 @@ func (c *Cache) Get(key interface{}) (interface{}, bool) {
 }
 
 func (c *Cache) Remove(key interface{}) bool {
-	return c.Cache.Remove(key)
+	removed := c.removeDurable(key)
+	return c.Cache.Remove(key) || removed
+}
+
+// setDurable 需持有durableMu，同时删除ARC中的同名值
+func (c *Cache) setDurable(key, value interface{}, ttl time.Duration) {
+	now := time.Now()
+	if len(c.durable) >= c.sweepAt {
+		for k, item := range c.durable {
+			if item.expired(now) {
+				delete(c.durable, k)
+			}
+		}
+		c.sweepAt = 2*len(c.durable) + cacheSize
+	}
+
+	item := durableItem{value: value}
+	if ttl > 0 {
+		item.expires = now.Add(ttl)
+	}
+	c.durable[key] = item
+	c.Cache.Remove(key)
+}
+
+// getDurable 需持有durableMu
+func (c *Cache) getDurable(key interface{}) (interface{}, bool) {
+	item, ok := c.durable[key]
+	if !ok {
+		return nil, false
+	}
+	if item.expired(time.Now()) {
+		delete(c.durable, key)
+		return nil, false
+	}
+	return item.value, true
+}
+
+func (c *Cache) removeDurable(key interface{}) bool {
+	c.durableMu.Lock()
+	defer c.durableMu.Unlock()
+	_, ok := c.durable[key]
+	delete(c.durable, key)
+	return ok
+}
+
+func (item durableItem) expired(now time.Time) bool {
+	return !item.expires.IsZero() && now.After(item.expires)
 }
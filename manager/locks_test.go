@@ -0,0 +1,154 @@
+package manager_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/manager"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// dryDialector 不连接数据库，AutoMigrate什么都不做
+type dryDialector struct{}
+
+type dryMigrator struct{ gorm.Migrator }
+
+func (dryMigrator) AutoMigrate(...interface{}) error { return nil }
+
+func (dryDialector) Name() string { return "dry" }
+func (dryDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	return nil
+}
+func (dryDialector) Migrator(*gorm.DB) gorm.Migrator { return dryMigrator{} }
+func (dryDialector) DataTypeOf(*schema.Field) string { return "" }
+func (dryDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+func (dryDialector) BindVarTo(w clause.Writer, _ *gorm.Statement, _ interface{}) { w.WriteByte('?') }
+func (dryDialector) QuoteTo(w clause.Writer, str string)                         { w.WriteString(str) }
+func (dryDialector) Explain(sql string, vars ...interface{}) string {
+	return gormlogger.ExplainSQL(sql, nil, `'`, vars...)
+}
+
+// lockedOrders 悲观锁表
+type lockedOrders struct {
+	btypes.VirtualTable
+}
+
+func (*lockedOrders) New() btypes.Tabler    { return &lockedOrders{} }
+func (*lockedOrders) TableName() string     { return "orders" }
+func (*lockedOrders) PessimisticLock() bool { return true }
+
+type userSession struct {
+	ID uint `json:"id"`
+}
+
+func (s *userSession) New() btypes.JwtSession { return &userSession{} }
+func (s *userSession) UserID() uint           { return s.ID }
+
+// push 推送或应答的类型及payload
+type push struct {
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+}
+
+func readPush(t *testing.T, conn *websocket.Conn) push {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var p push
+	require.NoError(t, conn.ReadJSON(&p))
+	return p
+}
+
+// assertSilent 一段时间内没有收到任何消息
+func assertSilent(t *testing.T, conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, msg, err := conn.ReadMessage()
+	assert.Error(t, err, "收到了 %s", msg)
+}
+
+func TestLockRecipients(t *testing.T) {
+	gdb, err := gorm.Open(dryDialector{}, &gorm.Config{DryRun: true, Logger: gormlogger.Discard})
+	require.NoError(t, err)
+	keys := middlewares.NewKeySet().Add(middlewares.HMACKey("", []byte("secret")))
+	cfg := &middlewares.LogioConfig{Keys: keys}
+	log := logger.MultiTargets{}
+
+	// 没有token的连接是匿名的，带token时认证
+	authenticate := cfg.WebsocketAuthenticator(&userSession{}, nil)
+	m := manager.New(gdb, cache.New(log), log, cfg.Authorize(&userSession{}), nil, "orders/lock", &lockedOrders{}).
+		AuthenticateWebsocket(func(r *http.Request) (interface{}, uint, time.Time, error) {
+			if r.URL.Query().Get("token") == "" {
+				return nil, 0, time.Time{}, nil
+			}
+			return authenticate(r)
+		})
+	engine := gin.New()
+	m.InitSystem(engine, nil)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	// 连接之前已有的锁
+	_, err = m.Locks().Acquire(btypes.LockKey("orders", 3), &userSession{ID: 9}, nil, time.Minute)
+	require.NoError(t, err)
+
+	dial := func(token string) *websocket.Conn {
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+		if token != "" {
+			url += "?token=" + token
+		}
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		return conn
+	}
+	subscribe := func(conn *websocket.Conn) push {
+		require.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type": manager.RouterSubscribe, "payload": map[string][]string{"topics": {"orders"}},
+		}))
+		return readPush(t, conn)
+	}
+
+	now := time.Now()
+	token, err := keys.Sign(jwt.MapClaims{"id": 1, "jti": "j", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	authed := dial(token)
+	defer authed.Close()
+	anonymous := dial("")
+	defer anonymous.Close()
+
+	// 认证的连接建立后收到该表当前的锁
+	locks := readPush(t, authed)
+	assert.Equal(t, btypes.PushTypeLocks, locks.Type)
+	assert.Equal(t, "orders", locks.Payload["table"])
+	if assert.Len(t, locks.Payload["locks"], 1) {
+		lease := locks.Payload["locks"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, btypes.LockKey("orders", 3), lease["key"])
+	}
+	assert.Equal(t, manager.RouterSubscribe+"_success", subscribe(authed).Type)
+
+	// 匿名的连接收不到锁，也不能订阅；第一个消息就是订阅失败的应答
+	assert.Equal(t, manager.RouterSubscribe+"_failure", subscribe(anonymous).Type)
+
+	// 锁的变化只通知订阅了该表的连接
+	m.Locks().Release(btypes.LockKey("orders", 3))
+	changed := readPush(t, authed)
+	assert.Equal(t, btypes.PushTypeLockChanged, changed.Type)
+	assert.Equal(t, btypes.LockKey("orders", 3), changed.Payload["lease"].(map[string]interface{})["key"])
+	assertSilent(t, anonymous)
+}
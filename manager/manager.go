@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/eruca/bisel/btypes"
 	"github.com/eruca/bisel/logger"
@@ -15,6 +18,15 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	// RouterSubscribe 订阅websocket广播，payload: {"topics": ["orders", "orders/3"]}
+	RouterSubscribe = "topic/subscribe"
+	// RouterUnsubscribe 取消订阅
+	RouterUnsubscribe = "topic/unsubscribe"
+)
+
+var _ btypes.Notifier = (*Manager)(nil)
+
 type Manager struct {
 	db                *btypes.DB
 	cacher            btypes.Cacher
@@ -24,17 +36,29 @@ type Manager struct {
 	pessimistic_locks map[string]struct{} // 开启了悲观锁
 	crt               btypes.ConfigResponseType
 	logger            logger.Logger
+	warmer            btypes.Warmer // 由Warmup设置
+	access            *btypes.AccessControl
+	locks             *btypes.LockRegistry
+	topics            *middlewares.Topics
+	hub               *ws.Hub
+	wsAuth            ws.Authenticate // 由AuthenticateWebsocket设置
+	pessimisticRouter string
+	jwtAction         btypes.Action
+	session           btypes.JwtSession // 由Session设置
 }
 
 // New Manager
+// jwtAction: 认证的Action(比如middlewares.JWTAuthorize)
+// 不为nil时注册topic/subscribe及topic/unsubscribe，写入只广播给订阅了该表或该行的websocket连接
+// 为nil时不能订阅，写入与之前一样广播给所有连接
 func New(gdb *gorm.DB, cacher btypes.Cacher, logger logger.Logger, jwtAction btypes.Action,
 	crt btypes.ConfigResponseType, pessimistic_router string, tablers ...btypes.Tabler) *Manager {
 
 	db := &btypes.DB{Gorm: gdb}
 	handlers := make(map[string]btypes.ContextConfig)
 
-	depends := make(map[string]map[string]struct{})
 	pessimistic := make(map[string]struct{})
+	access := btypes.NewAccessControl()
 
 	for _, tabler := range tablers {
 		if err := db.Gorm.AutoMigrate(tabler); err != nil {
@@ -48,22 +72,20 @@ func New(gdb *gorm.DB, cacher btypes.Cacher, logger logger.Logger, jwtAction bty
 		if tabler.PessimisticLock() {
 			pessimistic[tableName] = struct{}{}
 		}
-
-		// Iterate the tables depend on
-		for _, depend := range tabler.Depends() {
-			if m, ok := depends[depend]; ok {
-				// 如果依赖的表已经存在，也就是该依赖已经有map了
-				// 那么需要查看是否tableName在不在m里
-				// 如果depend发生改变，会查找所有depends下key为depend里存在的map下所有的key，删除其缓存
-				if _, ok = m[tableName]; !ok {
-					m[tableName] = struct{}{}
-				}
-			} else {
-				depends[depend] = map[string]struct{}{tableName: {}}
+		// 注册该表路由需要的权限
+		if permissioner, ok := tabler.(btypes.RoutePermissioner); ok {
+			for router, permission := range permissioner.RoutePermissions() {
+				access.Require(router, permission)
 			}
 		}
 	}
 
+	// depends 是传递闭包: 某表改变时，所有直接或间接依赖它的表都要清除缓存
+	depends, err := btypes.ResolveDepends(tablers)
+	if err != nil {
+		panic(err)
+	}
+
 	if len(pessimistic) > 0 {
 		if pessimistic_router == "" {
 			panic("必须设置pessimistic_router, 才能使用悲观锁")
@@ -72,11 +94,18 @@ func New(gdb *gorm.DB, cacher btypes.Cacher, logger logger.Logger, jwtAction bty
 		handlers[pessimistic_router] = middlewares.PessimisticLockHandler(pessimistic, middlewares.TimeElapsed, jwtAction)
 	}
 
+	// 订阅websocket广播的topic，需要认证，没有jwtAction时不能订阅，写入广播给所有连接
+	topics := middlewares.NewTopics(tablers...)
+	if jwtAction != nil {
+		handlers[RouterSubscribe] = middlewares.SubscribeHandler(topics, middlewares.TimeElapsed, jwtAction)
+		handlers[RouterUnsubscribe] = middlewares.UnsubscribeHandler(middlewares.TimeElapsed, jwtAction)
+	}
+
 	if crt == nil {
 		crt = defaultResponseType
 	}
 
-	return &Manager{
+	manager := &Manager{
 		db:                db,
 		cacher:            cacher,
 		tablers:           tablers,
@@ -85,18 +114,99 @@ func New(gdb *gorm.DB, cacher btypes.Cacher, logger logger.Logger, jwtAction bty
 		pessimistic_locks: pessimistic,
 		crt:               crt,
 		logger:            logger,
+		access:            access,
+		locks:             btypes.NewLockRegistry(0),
+		topics:            topics,
+		pessimisticRouter: pessimistic_router,
+		jwtAction:         jwtAction,
+		hub:               ws.NewHub(),
+	}
+	manager.locks.OnChange(manager.broadcastLock)
+	return manager
+}
+
+// LockLease 设置悲观锁租约的时长，默认是middlewares.DefaultLockTTL
+func (manager *Manager) LockLease(ttl time.Duration) *Manager {
+	if len(manager.pessimistic_locks) > 0 {
+		manager.handlers[manager.pessimisticRouter] = middlewares.ConfigPessimisticLockHandler(
+			manager.pessimistic_locks, ttl, middlewares.TimeElapsed, manager.jwtAction)
+	}
+	return manager
+}
+
+// Topic 注册可以订阅的自定义topic，permission不为空时订阅需要该权限
+// 表名及table/id不需要注册，订阅需要的权限用 AccessControl().Require(btypes.TopicRouter(表名), 权限) 设置
+func (manager *Manager) Topic(name, permission string) *Manager {
+	manager.topics.Add(name)
+	if permission != "" {
+		manager.access.Require(btypes.TopicRouter(name), permission)
+	}
+	return manager
+}
+
+// LockAdmin 在router注册悲观锁管理(查看及强制释放)，需要 btypes.PermissionLockAdmin
+func (manager *Manager) LockAdmin(router string) *Manager {
+	manager.handlers[router] = middlewares.LockAdminHandler(manager.pessimistic_locks,
+		middlewares.TimeElapsed, manager.jwtAction, middlewares.Authorization)
+	manager.access.Require(router, btypes.PermissionLockAdmin)
+	return manager
+}
+
+// LockLimit 设置每个用户最多持有的悲观锁，0表示不限制
+func (manager *Manager) LockLimit(limit int) *Manager {
+	manager.locks.SetLimit(limit)
+	return manager
+}
+
+// Session 设置登录使用的JwtSession，检查实现了SessionScoper的表的ScopeFields都是它的字段
+// 有这样的表时必须在InitSystem之前调用
+func (manager *Manager) Session(jwt btypes.JwtSession) *Manager {
+	if err := btypes.CheckScopeFields(jwt, manager.tablers...); err != nil {
+		panic(err)
 	}
+	manager.session = jwt
+	return manager
+}
+
+// WebsocketQueue 设置每个websocket连接的发送队列长度及溢出策略，需在InitSystem之前调用
+// 默认是ws.DefaultQueueSize及ws.Disconnect
+func (manager *Manager) WebsocketQueue(size int, overflow ws.OverflowPolicy) *Manager {
+	manager.hub.SetQueue(size, overflow)
+	return manager
+}
+
+// WebsocketStats 返回websocket连接的发送队列深度及丢弃的消息数
+func (manager *Manager) WebsocketStats() ws.Stats { return manager.hub.Stats() }
+
+// AuthenticateWebsocket 设置websocket握手时的认证，需在InitSystem之前调用
+// auth返回error时握手以401拒绝，比如middlewares.LogioConfig.WebsocketAuthenticator不允许匿名连接
+// 认证成功的session绑定在ws.Client上，该连接之后的请求不需要再带token
+func (manager *Manager) AuthenticateWebsocket(auth ws.Authenticate) *Manager {
+	manager.wsAuth = auth
+	return manager
 }
 
 // InitSystem 分别启动http,websocket
 // 返回可以启动链式操作StartTask
 // @afterConnected => 表示除tabler实现Connectter外，其他想要传送的数据
 func (manager *Manager) InitSystem(engine *gin.Engine, afterConnected btypes.Connectter) *Manager {
+	// ScopeFields在启动时检查，不等到请求时才panic
+	if manager.session == nil {
+		for _, tabler := range manager.tablers {
+			if _, ok := tabler.(btypes.SessionScoper); ok {
+				panic(fmt.Sprintf("%s 实现了SessionScoper，需先用Session设置JwtSession", tabler.TableName()))
+			}
+		}
+	}
+
 	engine.POST("/:table/:crud", func(c *gin.Context) {
 		table, crud := strings.TrimSpace(c.Param("table")), strings.TrimSpace(c.Param("crud"))
 		router := fmt.Sprintf("%s/%s", table, crud)
 		// 产生btypes.Request
 		req := btypes.FromHttpRequest(router, c.Request.Body)
+		if req.ETag == "" {
+			req.ETag = c.GetHeader("If-None-Match")
+		}
 		manager.logger.Debugf("\nhttp request from client: %-v", req)
 
 		err := manager.TakeActionHttp(c.Writer, req, c.Request)
@@ -107,7 +217,7 @@ func (manager *Manager) InitSystem(engine *gin.Engine, afterConnected btypes.Con
 	})
 
 	// 构建读入信息后的处理函数
-	processMixHttpRequest := func(httpReq *http.Request) (ws.Process, ws.ClearUserID) {
+	processMixHttpRequest := func(httpReq *http.Request) (ws.Process, ws.Disconnected) {
 		// 进入该函数，表示一条websocket连接
 		// 应该还是在单线程里执行
 		return func(client *ws.Client, broadcast chan ws.BroadcastRequest, msg []byte) {
@@ -118,20 +228,20 @@ func (manager *Manager) InitSystem(engine *gin.Engine, afterConnected btypes.Con
 			err := manager.TakeActionWebsocket(client, broadcast, req, httpReq)
 			if err != nil {
 				resp := btypes.BuildErrorResposeFromRequest(manager.crt, req, err)
-				client.Send <- resp.JSON()
+				manager.reply(client, req, resp.JSON())
 			}
-		}, manager.ClearUserID
+		}, manager.Disconnected
 	}
 	// 连接成功后马上发送的数据
-	connected := func(send chan<- []byte) {
+	connected := func(client *ws.Client) {
 		manager.logger.Infof("Connected now, will send some data to client")
-		manager.Connected(send)
+		manager.Connected(client)
 		if afterConnected != nil {
 			resp := afterConnected.Push(manager.db, manager.cacher, manager.logger, manager.crt)
-			send <- resp.JSON()
+			client.Push(resp.JSON())
 		}
 	}
-	wsHandler := ws.WebsocketHandler(processMixHttpRequest, connected, manager.logger)
+	wsHandler := ws.WebsocketHandler(manager.hub, processMixHttpRequest, connected, manager.wsAuth, manager.logger)
 	engine.GET("/ws", func(c *gin.Context) {
 		wsHandler(c.Writer, c.Request)
 	})
@@ -148,9 +258,7 @@ func (manager *Manager) TakeActionWebsocket(client *ws.Client, broadcast chan ws
 	}
 
 	var ctx btypes.Context
-	ctx.Init(manager.db, manager.cacher, client, httpReq, req,
-		manager.depends, manager.pessimistic_locks,
-		manager.crt, manager.logger, btypes.WEBSOCKET)
+	manager.initContext(&ctx, client, httpReq, req, btypes.WEBSOCKET)
 
 	// 在这里会对paramContext进行初始化, 还没有开始走流程
 	err = contextConfig(&ctx)
@@ -169,7 +277,7 @@ func (manager *Manager) TakeActionWebsocket(client *ws.Client, broadcast chan ws
 		panic("需要返回一个结果给客户端, 是否在某个middleware中，忘记调用c.Next()了")
 	}
 
-	client.Send <- ctx.Responder.JSON()
+	manager.reply(client, req, ctx.Responder.JSON())
 
 	if ctx.Responder.Broadcast() {
 		ctx.Responder.RemoveUUID()
@@ -177,6 +285,7 @@ func (manager *Manager) TakeActionWebsocket(client *ws.Client, broadcast chan ws
 		broadcast <- ws.BroadcastRequest{
 			Data:     ctx.Responder.JSON(),
 			Producer: client.Send,
+			Topics:   manager.writeTopics(ctx.Tabler),
 		}
 	}
 	// 打印调用顺序及结果
@@ -190,14 +299,12 @@ func (manager *Manager) TakeActionHttp(clientWriter io.Writer, req *btypes.Reque
 	httpReq *http.Request) (err error) {
 
 	contextConfig, ok := manager.handlers[req.Type]
-	if ok {
+	if !ok {
 		return fmt.Errorf("%q router not implemented yet", req.Type)
 	}
 
 	var ctx btypes.Context
-	ctx.Init(manager.db, manager.cacher, nil, httpReq, req,
-		manager.depends, manager.pessimistic_locks,
-		manager.crt, manager.logger, btypes.HTTP)
+	manager.initContext(&ctx, nil, httpReq, req, btypes.HTTP)
 
 	// 在这里会对paramContext进行初始化, 还没有开始走流程
 	err = contextConfig(&ctx)
@@ -212,37 +319,137 @@ func (manager *Manager) TakeActionHttp(clientWriter io.Writer, req *btypes.Reque
 	if ctx.Responder == nil {
 		panic("需要返回一个结果给客户端, 是否在某个middleware中，忘记调用c.Next()了")
 	}
+	if w, ok := clientWriter.(http.ResponseWriter); ok {
+		if etag := ctx.Responder.EntityTag(); etag != "" {
+			w.Header().Set("ETag", strconv.Quote(etag))
+		}
+		// 数据未改变，304不带body
+		if btypes.IsNotModified(ctx.Responder) {
+			w.WriteHeader(http.StatusNotModified)
+			ctx.LogResults()
+			return
+		}
+	}
 	clientWriter.Write(ctx.Responder.JSON())
 	ctx.LogResults()
 	return
 }
 
-func (manager *Manager) ClearUserID(userid uint) {
-	key, ok := manager.cacher.Get(userid)
-	if !ok {
-		// panic("key:userid not exist now, should be")
-		manager.logger.Warnf("key:userid not exist now, should be")
-		return
+// initContext 用manager的配置初始化ctx
+func (manager *Manager) initContext(ctx *btypes.Context, client *ws.Client, httpReq *http.Request,
+	req *btypes.Request, connType btypes.ConnectionType) {
+
+	ctx.Init(manager.db, manager.cacher, client, httpReq, req,
+		manager.depends, manager.pessimistic_locks,
+		manager.crt, manager.logger, connType)
+	ctx.Warmer = manager.warmer
+	ctx.AccessControl = manager.access
+	ctx.Locks = manager.locks
+	ctx.Notifier = manager
+}
+
+// Locks 返回悲观锁的登记处
+func (manager *Manager) Locks() *btypes.LockRegistry { return manager.locks }
+
+// AccessControl 返回权限控制，可以继续声明路由需要的权限、赋予角色权限，或查看权限矩阵
+func (manager *Manager) AccessControl() *btypes.AccessControl { return manager.access }
+
+// Disconnected websocket连接断开时释放该连接获取的悲观锁
+// 同一用户其他连接获取的锁不受影响
+func (manager *Manager) Disconnected(client *ws.Client) {
+	for _, lease := range manager.locks.ReleaseClient(client) {
+		manager.logger.Infof("连接断开，释放 %s", lease)
 	}
-	uid, ok := manager.cacher.Get(key)
-	if !ok {
-		panic(fmt.Sprintf("key: table/id:%q should be exist", key))
+}
+
+// reply 应答不按溢出策略丢弃，只有连接已关闭(或因溢出而关闭)时才发送失败
+func (manager *Manager) reply(client *ws.Client, req *btypes.Request, data []byte) {
+	if !client.Reply(data) {
+		manager.logger.Warnf("websocket 连接 %d(%s) 已关闭，丢弃 %s 的应答", client.ID, client.Addr, req.Type)
 	}
-	if userid != uid {
-		panic(fmt.Sprintf("请求用户%d 与 存储的用户%d 不一致", userid, uid))
+}
+
+// SendToUser 推送给该用户的所有websocket连接，可以在Action或Task中调用
+func (manager *Manager) SendToUser(userID uint, resp btypes.Responder) {
+	manager.hub.SendToUsers(resp.JSON(), userID)
+}
+
+// SendToUsers 推送给这些用户的所有websocket连接
+func (manager *Manager) SendToUsers(userIDs []uint, resp btypes.Responder) {
+	manager.hub.SendToUsers(resp.JSON(), userIDs...)
+}
+
+// Publish 向订阅了topics的websocket客户端推送
+func (manager *Manager) Publish(resp btypes.Responder, topics ...string) {
+	manager.hub.Publish(resp.JSON(), topics...)
+}
+
+// writeTopics 写入广播到该表及该行的topic，不是数据表时广播给所有连接
+// 没有jwtAction时无法订阅，也广播给所有连接
+func (manager *Manager) writeTopics(tabler btypes.Tabler) []string {
+	if manager.jwtAction == nil || tabler == nil || tabler.TableName() == "" {
+		return nil
+	}
+	topics := []string{tabler.TableName()}
+	if id := tabler.Model().ID; id > 0 {
+		topics = append(topics, btypes.LockKey(tabler.TableName(), id))
+	}
+	return topics
+}
+
+// broadcastLock 锁被获取或释放时通知订阅了该表或该行的websocket客户端
+func (manager *Manager) broadcastLock(event btypes.LockEvent) {
+	resp := &btypes.Response{Type: btypes.PushTypeLockChanged}
+	resp.Add(btypes.Pair{Key: "event", Value: event.Event},
+		btypes.Pair{Key: "reason", Value: event.Reason},
+		btypes.Pair{Key: "lease", Value: event.Lease})
+	manager.hub.Publish(resp.JSON(), event.Lease.TableName(), event.Lease.Key)
+}
+
+// ClearUserID 释放该用户持有的所有悲观锁，包括该用户其他连接获取的
+// 只释放某个连接获取的锁使用Disconnected
+func (manager *Manager) ClearUserID(userid uint) {
+	manager.locks.ReleaseUser(userid)
+}
+
+// Depends 返回解析后的缓存依赖图: 表名 => 该表改变时需要清除缓存的表
+func (manager *Manager) Depends() map[string][]string {
+	graph := make(map[string][]string, len(manager.depends))
+	for tableName, dependents := range manager.depends {
+		tables := make([]string, 0, len(dependents))
+		for dependent := range dependents {
+			tables = append(tables, dependent)
+		}
+		sort.Strings(tables)
+		graph[tableName] = tables
 	}
-	manager.cacher.Remove(key)
-	manager.cacher.Remove(userid)
+	return graph
 }
 
-// Connected 当连接建立时
-func (manager *Manager) Connected(c chan<- []byte) {
+// Connected 当连接建立时，推送Connectter的数据及悲观锁表当前的锁
+func (manager *Manager) Connected(client *ws.Client) {
 	for _, tabler := range manager.tablers {
 		if connecter, ok := tabler.(btypes.Connectter); ok {
 			responder := connecter.Push(manager.db, manager.cacher, manager.logger, manager.crt)
-			c <- responder.JSON()
+			client.Push(responder.JSON())
 		}
+		// 锁包含持有者的信息，只推送给可以订阅该表的已认证连接
+		if tabler.PessimisticLock() && manager.canReadTable(client, tabler.TableName()) {
+			resp := &btypes.Response{Type: btypes.PushTypeLocks}
+			resp.Add(btypes.Pair{Key: "table", Value: tabler.TableName()},
+				btypes.Pair{Key: "locks", Value: manager.locks.TableLocks(tabler.TableName())})
+			client.Push(resp.JSON())
+		}
+	}
+}
+
+// canReadTable 连接绑定的session可以订阅该表的topic
+func (manager *Manager) canReadTable(client *ws.Client, tableName string) bool {
+	sess, ok := client.Session().(btypes.JwtSession)
+	if !ok {
+		return false
 	}
+	return manager.topics.CanReadTable(manager.access, sess, tableName) == nil
 }
 
 // 否则默认使用responseType作为ConfigResponseType
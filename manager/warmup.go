@@ -0,0 +1,127 @@
+package manager
+
+import (
+	"sync"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+var _ btypes.Warmer = (*warmer)(nil)
+
+// HotQuery 代表热点查询，启动时预热，其所在表的缓存被清除后会在后台重新查询
+type HotQuery struct {
+	Tabler btypes.Tabler
+	// Action 与DefaultPush一致，请求类型为 表名/Action
+	Action string
+	// Param 未设置Size/Orderby时使用Tabler的默认设置
+	Param btypes.QueryParam
+}
+
+func (hq *HotQuery) requestType() string { return hq.Tabler.TableName() + "/" + hq.Action }
+
+type warmer struct {
+	manager *Manager
+	hots    map[string][]HotQuery        // 表名 => 该表的热点查询
+	pushes  map[string]btypes.Connectter // 表名 => 实现了Connectter的Tabler
+	sem     chan struct{}                // 限制同时查询数据库的数量
+
+	mu      sync.Mutex
+	pending map[string]struct{} // 正在排队或查询中的预热，避免重复
+}
+
+// Warmup 开启缓存预热
+// 启动时在后台预热所有实现了Connectter的Tabler(即DefaultPush的默认查询)以及hots
+// 之后每次写操作清除缓存后，重新查询该表的Connectter.Push及相关的hots
+// concurrency: 预热时最多同时查询数据库的数量
+func (manager *Manager) Warmup(concurrency int, hots ...HotQuery) *Manager {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	w := &warmer{
+		manager: manager,
+		hots:    make(map[string][]HotQuery),
+		pushes:  make(map[string]btypes.Connectter),
+		sem:     make(chan struct{}, concurrency),
+		pending: make(map[string]struct{}),
+	}
+	for _, hot := range hots {
+		if hot.Param.Size == 0 {
+			hot.Param.Size = int64(hot.Tabler.Size())
+		}
+		if hot.Param.Orderby == "" {
+			hot.Param.Orderby = hot.Tabler.Orderby()
+		}
+		tableName := hot.Tabler.TableName()
+		w.hots[tableName] = append(w.hots[tableName], hot)
+	}
+	manager.warmer = w
+
+	for _, tabler := range manager.tablers {
+		if connecter, ok := tabler.(btypes.Connectter); ok {
+			w.pushes[tabler.TableName()] = connecter
+			w.warmPush(tabler.TableName())
+		}
+	}
+	for _, queries := range w.hots {
+		w.warmQueries(queries)
+	}
+	return manager
+}
+
+func (w *warmer) Warm(tableNames ...string) {
+	for _, tableName := range tableNames {
+		w.warmPush(tableName)
+		w.warmQueries(w.hots[tableName])
+	}
+}
+
+// warmPush 重新生成该表Connectter.Push(比如DefaultPush)的缓存
+func (w *warmer) warmPush(tableName string) {
+	connecter, ok := w.pushes[tableName]
+	if !ok {
+		return
+	}
+	w.schedule("push:"+tableName, func() {
+		m := w.manager
+		connecter.Push(m.db, m.cacher, m.logger, m.crt)
+	})
+}
+
+func (w *warmer) warmQueries(queries []HotQuery) {
+	for i := range queries {
+		hot := queries[i]
+		reqType := hot.requestType()
+		w.schedule(reqType+":"+hot.Param.BuildCacheKey(reqType), func() {
+			m := w.manager
+			btypes.PushQuery(m.db, m.cacher, m.logger, m.crt, hot.Tabler, reqType, hot.Param)
+		})
+	}
+}
+
+// schedule 在后台执行预热，同一个key在开始执行之前不会重复排队
+// 开始执行后就移出pending，这样执行期间发生的写操作会再排队一次，不会留下旧数据
+func (w *warmer) schedule(key string, fn func()) {
+	w.mu.Lock()
+	if _, ok := w.pending[key]; ok {
+		w.mu.Unlock()
+		return
+	}
+	w.pending[key] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		w.sem <- struct{}{}
+		w.mu.Lock()
+		delete(w.pending, key)
+		w.mu.Unlock()
+
+		defer func() {
+			<-w.sem
+			if r := recover(); r != nil {
+				w.manager.logger.Errorf("warm up %s failed: %v", key, r)
+			}
+		}()
+		fn()
+		w.manager.logger.Infof("warm up %s", key)
+	}()
+}
@@ -0,0 +1,91 @@
+package manager_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/manager"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// recordLogger 记录Errorf的内容
+type recordLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (*recordLogger) Debugf(string, ...interface{}) {}
+func (*recordLogger) Infof(string, ...interface{})  {}
+func (*recordLogger) Warnf(string, ...interface{})  {}
+func (l *recordLogger) Errorf(tmpl string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(tmpl, args...))
+}
+
+func (l *recordLogger) logged(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range l.errors {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// myOrders 查询结果依赖于session的id
+type myOrders struct {
+	btypes.VirtualTable
+}
+
+func (*myOrders) New() btypes.Tabler    { return &myOrders{} }
+func (*myOrders) TableName() string     { return "orders" }
+func (*myOrders) ScopeFields() []string { return []string{"id"} }
+func (*myOrders) Query(*btypes.Context, btypes.Tabler, *btypes.QueryParam, btypes.JwtSession) (btypes.Result, error) {
+	var result btypes.Result
+	result.Payloads.Add("orders", []int{1, 2})
+	return result, nil
+}
+
+// brokenTable 查询总是失败
+type brokenTable struct {
+	btypes.VirtualTable
+}
+
+func (*brokenTable) New() btypes.Tabler { return &brokenTable{} }
+func (*brokenTable) TableName() string  { return "broken" }
+func (*brokenTable) Query(*btypes.Context, btypes.Tabler, *btypes.QueryParam, btypes.JwtSession) (btypes.Result, error) {
+	return btypes.Result{}, errors.New("db down")
+}
+
+func TestWarmup(t *testing.T) {
+	gdb, err := gorm.Open(nil, &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+	log := &recordLogger{}
+	cacher := cache.New(log)
+	param := btypes.QueryParam{Size: 20, Orderby: "id DESC"}
+
+	manager.New(gdb, cacher, log, nil, nil, "").Warmup(2,
+		manager.HotQuery{Tabler: &myOrders{}, Action: "query", Param: param},
+		manager.HotQuery{Tabler: &brokenTable{}, Action: "query", Param: param})
+
+	// 预热没有session，缓存在匿名范围的键下，与请求时计算的一致
+	key := param.BuildCacheKey(btypes.ScopedRequestType(&myOrders{}, nil, "orders/query"))
+	assert.Eventually(t, func() bool { return cacher.GetBucket("orders", key) != nil }, time.Second, 10*time.Millisecond)
+	assert.JSONEq(t, `{"orders":[1,2]}`, string(cacher.GetBucket("orders", key)))
+	assert.Nil(t, cacher.GetBucket("orders", param.BuildCacheKey("orders/query")))
+
+	// 查询失败时记录错误，不缓存
+	assert.Eventually(t, func() bool { return log.logged("db down") }, time.Second, 10*time.Millisecond)
+	assert.True(t, log.logged("warm up broken/query"))
+	assert.Nil(t, cacher.GetBucket("broken", param.BuildCacheKey(btypes.ScopedRequestType(&brokenTable{}, nil, "broken/query"))))
+}
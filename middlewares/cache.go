@@ -3,78 +3,212 @@ package middlewares
 import (
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/eruca/bisel/btypes"
 )
 
 const (
 	PairKeyCache = "Flow @Cache"
+
+	// 等待其他请求重建缓存的默认超时时间
+	defaultRebuildTimeout = 5 * time.Second
 )
 
+var defaultUseCache = ConfigUseCache(defaultRebuildTimeout)
+
 func UseCache(c *btypes.Context) btypes.PairStringer {
-	// 如果没有cache，直接跳过
-	if c.Cacher == nil {
-		panic("使用了Cache，而cacher却是nil，需设置")
-	}
+	return defaultUseCache(c)
+}
 
-	c.Logger.Warnf("Use Cache: %v", c.Parameter.Status())
-	switch c.Parameter.Status() {
-	case btypes.StatusNoop:
-		c.Next()
-		return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString("No op")}
-
-	case btypes.StatusRead:
-		// params := c.ParamContext.QueryParam
-		// 如果客户端请求没有Hash这个值或者要求强制走数据库，就是没有缓存过
-		// 直接跳过
-		if c.Parameter.ReadForceUpdate() {
-			return noExistInCache(c)
-		}
+// ConfigUseCache 返回一个缓存Action
+// 同一个表的同一个缓存键同时未命中时，只有第一个请求查询数据库，其他请求等待其结果
+// timeout: 等待重建的最长时间，超时返回 btypes.ErrCacheRebuildTimeout
+func ConfigUseCache(timeout time.Duration) btypes.Action {
+	group := &flightGroup{flights: make(map[string]*flight)}
 
-		cacheKey := c.BuildCacheKey(c.Request.Type)
-		bin := c.Cacher.GetBucket(c.TableName(), cacheKey)
-		if bin != nil {
-			c.Responder = btypes.NewRawResponse(c.ConfigResponseType, c.Request, bin)
-			return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(bin)}
-		}
-		return noExistInCache(c)
-
-	case btypes.StatusWrite:
-		var builder strings.Builder
-		builder.WriteString("clear cache: ")
-		tableName := c.TableName()
-		builder.WriteString(tableName)
-
-		c.Cacher.ClearBuckets(tableName)
-		for key := range c.Depends[tableName] {
-			c.Cacher.ClearBuckets(key)
-			builder.WriteByte(',')
-			builder.WriteString(key)
+	return func(c *btypes.Context) btypes.PairStringer {
+		// 如果没有cache，直接跳过
+		if c.Cacher == nil {
+			panic("使用了Cache，而cacher却是nil，需设置")
 		}
 
-		c.Next()
-		return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(builder.String())}
+		c.Logger.Warnf("Use Cache: %v", c.Parameter.Status())
+		switch c.Parameter.Status() {
+		case btypes.StatusNoop:
+			c.Next()
+			return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString("No op")}
+
+		case btypes.StatusRead:
+			// params := c.ParamContext.QueryParam
+			// 如果客户端请求没有Hash这个值或者要求强制走数据库，就是没有缓存过
+			// 直接跳过
+			if c.Parameter.ReadForceUpdate() {
+				return noExistInCache(c, group, timeout)
+			}
+
+			cacheKey := c.CacheKey()
+			bin := c.Cacher.GetBucket(c.TableName(), cacheKey)
+			if bin != nil {
+				if respondPayload(c, bin) {
+					return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString("not modified: " + c.Request.ETag)}
+				}
+				return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(bin)}
+			}
+			return noExistInCache(c, group, timeout)
+
+		case btypes.StatusWrite:
+			var builder strings.Builder
+			builder.WriteString("clear cache: ")
+			tableName := c.TableName()
+			builder.WriteString(tableName)
+
+			cleared := []string{tableName}
+			c.Cacher.ClearBuckets(tableName)
+			for key := range c.Depends[tableName] {
+				c.Cacher.ClearBuckets(key)
+				cleared = append(cleared, key)
+				builder.WriteByte(',')
+				builder.WriteString(key)
+			}
+
+			c.Next()
+			// 写入成功后再预热，否则会把旧数据又缓存起来
+			if c.Success && c.Warmer != nil {
+				c.Warmer.Warm(cleared...)
+			}
+			return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(builder.String())}
 
-	default:
-		panic("unknown status")
+		default:
+			panic("unknown status")
+		}
 	}
 }
 
-func noExistInCache(c *btypes.Context) btypes.PairStringer {
+func noExistInCache(c *btypes.Context, group *flightGroup, timeout time.Duration) btypes.PairStringer {
+	tableName := c.Tabler.TableName()
+	// key是按照查询参数(及session范围)MD5计算出来的hash值
+	key := c.CacheKey()
+
+	f, leader := group.join(tableName + "/" + key)
+	if !leader {
+		return waitForRebuild(c, f, timeout)
+	}
+
+	defer func() {
+		// 数据库查询panic时，也要通知等待者
+		if r := recover(); r != nil {
+			group.finish(f, nil, fmt.Errorf("%w: %v", btypes.ErrCacheRebuildFailed, r))
+			panic(r)
+		}
+	}()
+
 	// 先进行后面的操作，返回的时候应该已经有Response了
 	// 就可以对其进行缓存
 	c.Next()
 	if c.Responder == nil {
 		panic("这个时候应该有对客户端的回应了，可是没有")
 	}
-	// key是按照查询参数MD5计算出俩的hash值
-	key := c.BuildCacheKey(c.Request.Type)
+	if !c.Success {
+		err := c.Err
+		if err == nil {
+			err = btypes.ErrCacheRebuildFailed
+		}
+		group.finish(f, nil, err)
+		return btypes.PairStringer{
+			Key:   PairKeyCache,
+			Value: btypes.ValueString(fmt.Sprintf("rebuild cache from %s failed: %v", c.Request.Type, err)),
+		}
+	}
+
 	// 设置缓存
 	// 只能缓存payload,如果缓存responder，则会加入uuid
-	c.Cacher.SetBucket(c.Tabler.TableName(), key, c.Responder.JSONPayload())
+	payload := c.Responder.JSONPayload()
+	c.Cacher.SetBucket(tableName, key, payload)
+	group.finish(f, payload, nil)
+
+	etag := btypes.PayloadETag(payload)
+	if c.Request.ETagMatches(etag) {
+		c.Responder = btypes.NewNotModifiedResponse(c.ConfigResponseType, c.Request, etag)
+	} else {
+		c.Responder.SetETag(etag)
+	}
 
 	return btypes.PairStringer{
 		Key:   PairKeyCache,
 		Value: btypes.ValueString(fmt.Sprintf("rebuild cache from %s: %v", c.Request.Type, c.Parameter)),
 	}
 }
+
+// waitForRebuild 等待正在重建的请求，使用其结果作为应答
+func waitForRebuild(c *btypes.Context, f *flight, timeout time.Duration) btypes.PairStringer {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+	case <-timer.C:
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, btypes.ErrCacheRebuildTimeout)
+		return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(btypes.ErrCacheRebuildTimeout.Error())}
+	}
+
+	if f.err != nil {
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, f.err)
+		return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString(f.err.Error())}
+	}
+	respondPayload(c, f.payload)
+	return btypes.PairStringer{Key: PairKeyCache, Value: btypes.ValueString("wait for rebuilding cache: " + string(f.payload))}
+}
+
+// respondPayload 用缓存的payload应答，如果客户端带来的ETag与之一致，则应答not_modified
+// @return 是否not_modified
+func respondPayload(c *btypes.Context, payload []byte) bool {
+	etag := btypes.PayloadETag(payload)
+	if c.Request.ETagMatches(etag) {
+		c.Responder = btypes.NewNotModifiedResponse(c.ConfigResponseType, c.Request, etag)
+		return true
+	}
+
+	rr := btypes.NewRawResponse(c.ConfigResponseType, c.Request, payload)
+	rr.SetETag(etag)
+	c.Responder = rr
+	return false
+}
+
+// flight 代表一次正在进行的缓存重建
+type flight struct {
+	key     string
+	done    chan struct{}
+	payload []byte
+	err     error
+}
+
+// flightGroup 以 表名/缓存键 合并同时发生的缓存重建
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// join 返回该key正在进行的重建，如果没有则新建一个，并由调用者(leader)负责重建
+func (g *flightGroup) join(key string) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{key: key, done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish 结束重建，并唤醒所有等待者
+func (g *flightGroup) finish(f *flight, payload []byte, err error) {
+	g.mu.Lock()
+	delete(g.flights, f.key)
+	g.mu.Unlock()
+
+	f.payload, f.err = payload, err
+	close(f.done)
+}
@@ -0,0 +1,146 @@
+package middlewares_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowQuery 模拟数据库查询，进入后等待release，err不为nil时查询失败
+type slowQuery struct {
+	calls   int32
+	entered chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func newSlowQuery(err error) *slowQuery {
+	return &slowQuery{entered: make(chan struct{}, 16), release: make(chan struct{}), err: err}
+}
+
+func (q *slowQuery) action(c *btypes.Context) btypes.PairStringer {
+	atomic.AddInt32(&q.calls, 1)
+	q.entered <- struct{}{}
+	<-q.release
+
+	if q.err != nil {
+		c.Err = q.err
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, q.err)
+		return btypes.PairStringer{}
+	}
+	resp := btypes.BuildFromRequest(c.ConfigResponseType, c.Request, true, false)
+	resp.Add(btypes.Pair{Key: "data", Value: "rows"})
+	c.Responder, c.Success = resp, true
+	return btypes.PairStringer{}
+}
+
+// runQuery 以同样的查询参数查询users，返回应答
+func runQuery(useCache btypes.Action, cacher btypes.Cacher, q *slowQuery) btypes.Responder {
+	c := &btypes.Context{
+		Cacher:             cacher,
+		Logger:             logger.MultiTargets{},
+		ConfigResponseType: func(typ string, ok bool) string { return typ },
+		Tabler:             &registerUser{},
+		Parameter:          &btypes.QueryParameter{},
+		Request:            &btypes.Request{Type: "users/query"},
+	}
+	c.AddActions(useCache, q.action)
+	c.StartWorkFlow()
+	return c.Responder
+}
+
+// concurrentQueries leader进入查询后再发起n个相同的查询，稍后放行leader
+func concurrentQueries(useCache btypes.Action, cacher btypes.Cacher, q *slowQuery, n int) []btypes.Responder {
+	responses := make([]btypes.Responder, n+1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = runQuery(useCache, cacher, q)
+	}()
+	<-q.entered
+
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = runQuery(useCache, cacher, q)
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(q.release)
+	wg.Wait()
+	return responses
+}
+
+func errorOf(resp btypes.Responder) interface{} {
+	return resp.(*btypes.Response).Payload["err"]
+}
+
+func TestCacheSingleFlight(t *testing.T) {
+	cacher := cache.New(logger.MultiTargets{})
+	useCache := middlewares.ConfigUseCache(time.Second)
+	q := newSlowQuery(nil)
+
+	// 同时未命中只查询一次数据库，所有请求都得到leader的结果
+	responses := concurrentQueries(useCache, cacher, q, 10)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&q.calls))
+	for _, resp := range responses {
+		require.NotNil(t, resp)
+		assert.JSONEq(t, `{"data":"rows"}`, string(resp.JSONPayload()))
+	}
+
+	// 之后命中缓存，不再查询
+	cached := newSlowQuery(nil)
+	assert.JSONEq(t, `{"data":"rows"}`, string(runQuery(useCache, cacher, cached).JSONPayload()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cached.calls))
+}
+
+func TestCacheSingleFlightError(t *testing.T) {
+	cacher := cache.New(logger.MultiTargets{})
+	useCache := middlewares.ConfigUseCache(time.Second)
+	q := newSlowQuery(errors.New("db down"))
+
+	// 等待者得到leader的错误，不各自查询
+	responses := concurrentQueries(useCache, cacher, q, 5)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&q.calls))
+	for _, resp := range responses {
+		assert.Equal(t, "db down", errorOf(resp))
+	}
+
+	// 失败的结果不缓存，下一次重新查询
+	retry := newSlowQuery(nil)
+	close(retry.release)
+	assert.JSONEq(t, `{"data":"rows"}`, string(runQuery(useCache, cacher, retry).JSONPayload()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&retry.calls))
+}
+
+func TestCacheRebuildTimeout(t *testing.T) {
+	cacher := cache.New(logger.MultiTargets{})
+	useCache := middlewares.ConfigUseCache(20 * time.Millisecond)
+	q := newSlowQuery(nil)
+
+	leader := make(chan btypes.Responder)
+	go func() { leader <- runQuery(useCache, cacher, q) }()
+	<-q.entered
+
+	// 等待超时返回ErrCacheRebuildTimeout，不查询数据库
+	assert.Equal(t, btypes.ErrCacheRebuildTimeout.Error(), errorOf(runQuery(useCache, cacher, q)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&q.calls))
+
+	// leader不受影响，完成后写入缓存
+	close(q.release)
+	assert.JSONEq(t, `{"data":"rows"}`, string((<-leader).JSONPayload()))
+	cached := newSlowQuery(nil)
+	assert.JSONEq(t, `{"data":"rows"}`, string(runQuery(useCache, cacher, cached).JSONPayload()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&cached.calls))
+}
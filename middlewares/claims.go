@@ -0,0 +1,133 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eruca/bisel/btypes"
+)
+
+// tokenClaims 签发及解析的claims
+// session的字段(按json)与标准claims平铺在一起，同名时以标准claims为准
+type tokenClaims struct {
+	jwt.StandardClaims
+	Type string `json:"typ,omitempty"`
+	Gen  int64  `json:"gen"`
+
+	session btypes.JwtSession
+	// 解析时用于校验
+	config *LogioConfig
+}
+
+// registeredClaims 用于编解码除session之外的部分
+type registeredClaims struct {
+	jwt.StandardClaims
+	Type string `json:"typ,omitempty"`
+	Gen  int64  `json:"gen"`
+}
+
+func (tc *tokenClaims) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if tc.session != nil {
+		data, err := json.Marshal(tc.session)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(registeredClaims{tc.StandardClaims, tc.Type, tc.Gen})
+	if err != nil {
+		return nil, err
+	}
+	var registered map[string]json.RawMessage
+	if err = json.Unmarshal(data, &registered); err != nil {
+		return nil, err
+	}
+	for k, v := range registered {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON 解码失败(比如字段类型不一致)返回error
+func (tc *tokenClaims) UnmarshalJSON(data []byte) error {
+	var registered registeredClaims
+	if err := json.Unmarshal(data, &registered); err != nil {
+		return err
+	}
+	tc.StandardClaims, tc.Type, tc.Gen = registered.StandardClaims, registered.Type, registered.Gen
+
+	if tc.session != nil {
+		return json.Unmarshal(data, tc.session)
+	}
+	return nil
+}
+
+// Valid 由jwt-go在验证签名之前调用，此时claims还不可信
+// 只做与签名无关的检查，不能据此查询缓存或数据库
+// 过期返回 btypes.ErrTokenExpired，其他都是 btypes.ErrInvalidToken
+// 时间比较都允许config.Leeway的时钟偏差
+func (tc *tokenClaims) Valid() error {
+	var leeway time.Duration
+	var issuer, audience string
+	if tc.config != nil {
+		leeway, issuer, audience = tc.config.Leeway, tc.config.Issuer, tc.config.Audience
+	}
+	now := time.Now()
+
+	switch {
+	case tc.ExpiresAt == 0 || tc.Id == "":
+		return btypes.ErrInvalidToken
+	case now.After(time.Unix(tc.ExpiresAt, 0).Add(leeway)):
+		return btypes.ErrTokenExpired
+	case tc.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(tc.IssuedAt, 0)):
+		return btypes.ErrInvalidToken
+	case tc.NotBefore != 0 && now.Add(leeway).Before(time.Unix(tc.NotBefore, 0)):
+		return btypes.ErrInvalidToken
+	case issuer != "" && tc.Issuer != issuer:
+		return btypes.ErrInvalidToken
+	case audience != "" && tc.Audience != audience:
+		return btypes.ErrInvalidToken
+	}
+	return nil
+}
+
+func (tc *tokenClaims) expires() time.Time { return time.Unix(tc.ExpiresAt, 0) }
+
+// signToken 用active的密钥签发token
+// typ: access/refresh, gen: 用户当前的token代数
+func (cfg *LogioConfig) signToken(sess btypes.JwtSession, typ string, gen int64, expire time.Duration) (string, error) {
+	now := time.Now()
+	claims := &tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        newTokenID(),
+			Issuer:    cfg.Issuer,
+			Audience:  cfg.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(expire).Unix(),
+		},
+		Type:    typ,
+		Gen:     gen,
+		session: sess,
+	}
+	return cfg.keySet().Sign(claims)
+}
+
+// parseToken 验证token并将session部分解码到sess
+// 只有签名有效时才报告过期，伪造的token一律是ErrInvalidToken
+func (cfg *LogioConfig) parseToken(tokenString string, sess btypes.JwtSession) (*tokenClaims, error) {
+	claims := &tokenClaims{session: sess, config: cfg}
+	if _, err := cfg.keySet().Parse(tokenString, claims); err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors == jwt.ValidationErrorClaimsInvalid &&
+			ve.Inner == btypes.ErrTokenExpired {
+			return nil, btypes.ErrTokenExpired
+		}
+		return nil, btypes.ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,129 @@
+package middlewares_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type claimsSession struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+func (*claimsSession) New() btypes.JwtSession { return &claimsSession{} }
+func (s *claimsSession) UserID() uint         { return s.ID }
+
+func TestTokenClaims(t *testing.T) {
+	salt := []byte("secret")
+	cfg := &middlewares.LogioConfig{Keys: middlewares.NewKeySet().Add(middlewares.HMACKey("", salt))}
+	auth := cfg.WebsocketAuthenticator(&claimsSession{}, nil)
+
+	token, err := middlewares.Generate_jwt(&claimsSession{ID: 7, Name: "张三"}, 1, salt)
+	require.NoError(t, err)
+	_, userid, expire, err := auth(httptest.NewRequest("GET", "/ws?token="+token, nil))
+	require.NoError(t, err)
+	assert.Equal(t, uint(7), userid)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expire, 2*time.Second)
+
+	// 过期与无效可以区分
+	expired, err := middlewares.Generate_jwt(&claimsSession{ID: 7}, -1, salt)
+	require.NoError(t, err)
+	_, _, _, err = auth(httptest.NewRequest("GET", "/ws?token="+expired, nil))
+	assert.Equal(t, btypes.ErrTokenExpired, err)
+
+	_, _, _, err = auth(httptest.NewRequest("GET", "/ws?token="+token+"x", nil))
+	assert.Equal(t, btypes.ErrInvalidToken, err)
+
+	// 签名无效时不报告过期，Valid在验证签名之前运行
+	forged, err := middlewares.Generate_jwt(&claimsSession{ID: 7}, -1, []byte("other"))
+	require.NoError(t, err)
+	_, _, _, err = auth(httptest.NewRequest("GET", "/ws?token="+forged, nil))
+	assert.Equal(t, btypes.ErrInvalidToken, err)
+}
+
+func TestTokenClaimsValidation(t *testing.T) {
+	keys := middlewares.NewKeySet().Add(middlewares.HMACKey("", []byte("secret")))
+	cfg := &middlewares.LogioConfig{Keys: keys, Issuer: "bisel", Audience: "web", Leeway: 30 * time.Second}
+	auth := cfg.WebsocketAuthenticator(&claimsSession{}, nil)
+
+	now := time.Now()
+	sign := func(claims jwt.MapClaims) error {
+		base := jwt.MapClaims{"id": 1, "jti": "j", "iss": "bisel", "aud": "web",
+			"iat": now.Unix(), "nbf": now.Unix(), "exp": now.Add(time.Minute).Unix()}
+		for k, v := range claims {
+			base[k] = v
+		}
+		token, err := keys.Sign(base)
+		require.NoError(t, err)
+		_, _, _, err = auth(httptest.NewRequest("GET", "/ws?token="+token, nil))
+		return err
+	}
+
+	assert.NoError(t, sign(nil))
+	// 时钟偏差之内
+	assert.NoError(t, sign(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}))
+	assert.NoError(t, sign(jwt.MapClaims{"nbf": now.Add(10 * time.Second).Unix()}))
+
+	assert.Equal(t, btypes.ErrTokenExpired, sign(jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}))
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"nbf": now.Add(time.Minute).Unix()}))
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"iat": now.Add(time.Minute).Unix()}))
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"iss": "other"}))
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"aud": "app"}))
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"jti": ""}))
+	// session字段类型不一致时返回error而不是panic
+	assert.Equal(t, btypes.ErrInvalidToken, sign(jwt.MapClaims{"id": "abc"}))
+}
+
+// roleClaimsSession 没有角色时token中不带roles
+type roleClaimsSession struct {
+	ID    uint     `json:"id"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+func (*roleClaimsSession) New() btypes.JwtSession { return &roleClaimsSession{} }
+func (s *roleClaimsSession) UserID() uint         { return s.ID }
+
+// authorizeHTTP 以http请求执行action，认证通过时返回本次请求的session
+func authorizeHTTP(action btypes.Action, cacher btypes.Cacher, token string) btypes.JwtSession {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	c := &btypes.Context{
+		ConnectionType:     btypes.HTTP,
+		Cacher:             cacher,
+		ConfigResponseType: func(typ string, ok bool) string { return typ },
+		Parameter:          &btypes.QueryParameter{CheckJWT: true},
+		HttpReq:            req,
+		Request:            &btypes.Request{Type: "orders/query"},
+	}
+
+	var sess btypes.JwtSession
+	c.AddActions(action, func(c *btypes.Context) btypes.PairStringer {
+		sess = c.JwtSess
+		return btypes.PairStringer{}
+	})
+	c.StartWorkFlow()
+	return sess
+}
+
+func TestAuthorizeFreshSession(t *testing.T) {
+	salt := []byte("secret")
+	cfg := &middlewares.LogioConfig{Keys: middlewares.NewKeySet().Add(middlewares.HMACKey("", salt))}
+	authorize := cfg.Authorize(&roleClaimsSession{})
+
+	admin, err := middlewares.Generate_jwt(&roleClaimsSession{ID: 1, Roles: []string{"admin"}}, 1, salt)
+	require.NoError(t, err)
+	user, err := middlewares.Generate_jwt(&roleClaimsSession{ID: 2}, 1, salt)
+	require.NoError(t, err)
+
+	// 依次解码，后一个token不能带上前一个的角色
+	assert.Equal(t, &roleClaimsSession{ID: 1, Roles: []string{"admin"}}, authorizeHTTP(authorize, nil, admin))
+	assert.Equal(t, &roleClaimsSession{ID: 2}, authorizeHTTP(authorize, nil, user))
+	assert.Nil(t, authorizeHTTP(authorize, nil, user+"x"))
+}
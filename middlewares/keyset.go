@@ -0,0 +1,300 @@
+package middlewares
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	errUnknownKey     = errors.New("未知的kid")
+	errRetiredKey     = errors.New("该kid已退役")
+	errAlgMismatch    = errors.New("token的alg与密钥不一致")
+	errNoActiveKey    = errors.New("没有用于签名的密钥")
+	errNoPrivateKey   = errors.New("该密钥没有私钥，只能用于验证")
+	errUnsupportedAlg = errors.New("不支持的alg")
+)
+
+// SigningKey 代表一个jwt签名密钥
+// HMAC: Private和Public都是[]byte
+// RSA/ECDSA/EdDSA: Private是私钥，只用于验证时可以为nil；Public是公钥
+type SigningKey struct {
+	ID      string // kid
+	Method  jwt.SigningMethod
+	Private interface{}
+	Public  interface{}
+	// Retired 退役的密钥既不签名也不再验证
+	Retired bool
+}
+
+// HMACKey 用共享的secret签名，与之前的salt方式兼容
+func HMACKey(kid string, secret []byte) *SigningKey {
+	return &SigningKey{ID: kid, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// KeySet 签名密钥的集合
+// 用active的密钥签名，header中写入kid；验证时按kid找到密钥，且token的alg必须与密钥一致
+// 轮换密钥: Add新密钥 => Activate新密钥 => 等旧token都过期后Retire旧密钥
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*SigningKey
+	active string
+}
+
+func NewKeySet() *KeySet {
+	return &KeySet{keys: make(map[string]*SigningKey)}
+}
+
+// Add 添加密钥，第一个添加的有私钥的密钥自动成为active
+func (ks *KeySet) Add(key *SigningKey) *KeySet {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	_, hasActive := ks.keys[ks.active]
+	ks.keys[key.ID] = key
+	if !hasActive && key.Private != nil {
+		ks.active = key.ID
+	}
+	return ks
+}
+
+// Activate 之后用kid的密钥签名
+func (ks *KeySet) Activate(kid string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return errUnknownKey
+	}
+	if key.Private == nil {
+		return errNoPrivateKey
+	}
+	key.Retired = false
+	ks.active = kid
+	return nil
+}
+
+// Retire 退役kid的密钥，用它签名的token不再有效
+func (ks *KeySet) Retire(kid string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if key, ok := ks.keys[kid]; ok {
+		key.Retired = true
+	}
+}
+
+// KeyIDs 返回所有未退役的kid
+func (ks *KeySet) KeyIDs() []string {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	kids := make([]string, 0, len(ks.keys))
+	for kid, key := range ks.keys {
+		if !key.Retired {
+			kids = append(kids, kid)
+		}
+	}
+	sort.Strings(kids)
+	return kids
+}
+
+// Sign 用active的密钥签名
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key, ok := ks.lookup("", true)
+	if !ok || key.Retired {
+		return "", errNoActiveKey
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.Private)
+}
+
+// Parse 验证并解析token到claims
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, ks.keyfunc)
+}
+
+// keyfunc 按kid找到密钥，没有kid的token使用kid为""的密钥(salt)
+// 严格检查alg，防止用公钥作为HMAC secret伪造token
+func (ks *KeySet) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, ok := ks.lookup(kid, false)
+	if !ok {
+		return nil, errUnknownKey
+	}
+	if key.Retired {
+		return nil, errRetiredKey
+	}
+	if t.Method == nil || t.Method.Alg() != key.Method.Alg() {
+		return nil, errAlgMismatch
+	}
+	return key.Public, nil
+}
+
+// lookup 在读锁内复制kid的密钥，Retire/Activate在写锁内修改原密钥
+// active为true时忽略kid，取active的密钥
+func (ks *KeySet) lookup(kid string, active bool) (SigningKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if active {
+		kid = ks.active
+	}
+	key, ok := ks.keys[kid]
+	if !ok {
+		return SigningKey{}, false
+	}
+	return *key, true
+}
+
+// LoadPEM 从PEM文件加载密钥并添加到KeySet
+// alg: RS256/RS384/RS512/PS256/.../ES256/ES384/ES512/EdDSA
+// privateFile为空时只用于验证；publicFile为空时从私钥导出公钥
+func (ks *KeySet) LoadPEM(kid, alg, privateFile, publicFile string) error {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil || strings.HasPrefix(alg, "HS") || alg == "none" {
+		return fmt.Errorf("%w: %q", errUnsupportedAlg, alg)
+	}
+	key := &SigningKey{ID: kid, Method: method}
+
+	if privateFile != "" {
+		data, err := ioutil.ReadFile(privateFile)
+		if err != nil {
+			return err
+		}
+		if key.Private, key.Public, err = parsePrivatePEM(alg, data); err != nil {
+			return fmt.Errorf("%s: %w", privateFile, err)
+		}
+	}
+	if publicFile != "" {
+		data, err := ioutil.ReadFile(publicFile)
+		if err != nil {
+			return err
+		}
+		if key.Public, err = parsePublicPEM(alg, data); err != nil {
+			return fmt.Errorf("%s: %w", publicFile, err)
+		}
+	}
+	if key.Public == nil {
+		return fmt.Errorf("kid %q 没有可用的公钥", kid)
+	}
+
+	ks.Add(key)
+	return nil
+}
+
+func parsePrivatePEM(alg string, data []byte) (private, public interface{}, err error) {
+	switch alg[:2] {
+	case "RS", "PS":
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "ES":
+		key, err := jwt.ParseECPrivateKeyFromPEM(data)
+		if err != nil {
+			// 不是SEC1格式，再试PKCS8
+			parsed, err8 := parsePKCS8PEM(data)
+			if key, ok := parsed.(*ecdsa.PrivateKey); ok && err8 == nil {
+				return key, &key.PublicKey, nil
+			}
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "Ed":
+		parsed, err := parsePKCS8PEM(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("不是Ed25519私钥")
+		}
+		return key, key.Public(), nil
+	}
+	return nil, nil, errUnsupportedAlg
+}
+
+func parsePKCS8PEM(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("不是PEM格式")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func parsePublicPEM(alg string, data []byte) (interface{}, error) {
+	switch alg[:2] {
+	case "RS", "PS":
+		return jwt.ParseRSAPublicKeyFromPEM(data)
+	case "ES":
+		return jwt.ParseECPublicKeyFromPEM(data)
+	case "Ed":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("不是PEM格式")
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("不是Ed25519公钥")
+		}
+		return key, nil
+	}
+	return nil, errUnsupportedAlg
+}
+
+// ***************************** EdDSA *********************************
+// jwt-go v3 没有EdDSA，这里实现Ed25519
+
+// SigningMethodEdDSA Ed25519签名
+var SigningMethodEdDSA = &signingMethodEd25519{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod { return SigningMethodEdDSA })
+}
+
+type signingMethodEd25519 struct{}
+
+func (*signingMethodEd25519) Alg() string { return "EdDSA" }
+
+func (*signingMethodEd25519) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (*signingMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
@@ -0,0 +1,139 @@
+package middlewares_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeKeyPair 将私钥(PKCS8)及公钥(PKIX)写入PEM文件
+func writeKeyPair(t *testing.T, dir, name string, private, public interface{}) (string, string) {
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+
+	privateFile := filepath.Join(dir, name+".key")
+	publicFile := filepath.Join(dir, name+".pub")
+	require.NoError(t, ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600))
+	require.NoError(t, ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0600))
+	return privateFile, publicFile
+}
+
+func TestKeySetAsymmetric(t *testing.T) {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	cases := []struct {
+		alg     string
+		private interface{}
+		public  interface{}
+	}{
+		{"RS256", rsaKey, &rsaKey.PublicKey},
+		{"ES256", ecKey, &ecKey.PublicKey},
+		{"EdDSA", edPrivate, edPublic},
+	}
+
+	for _, tc := range cases {
+		privateFile, publicFile := writeKeyPair(t, dir, tc.alg, tc.private, tc.public)
+
+		signer := middlewares.NewKeySet()
+		require.NoError(t, signer.LoadPEM(tc.alg, tc.alg, privateFile, ""))
+		token, err := signer.Sign(jwt.MapClaims{"id": 1})
+		require.NoError(t, err, tc.alg)
+
+		// 其他服务只需要公钥就可以验证
+		verifier := middlewares.NewKeySet()
+		require.NoError(t, verifier.LoadPEM(tc.alg, tc.alg, "", publicFile))
+		_, err = verifier.Parse(token, jwt.MapClaims{})
+		assert.NoError(t, err, tc.alg)
+
+		_, err = verifier.Sign(jwt.MapClaims{"id": 1})
+		assert.Error(t, err, "只有公钥不能签名")
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	keys := middlewares.NewKeySet().Add(middlewares.HMACKey("k1", []byte("secret1")))
+	old, err := keys.Sign(jwt.MapClaims{"id": 1})
+	require.NoError(t, err)
+
+	keys.Add(middlewares.HMACKey("k2", []byte("secret2")))
+	require.NoError(t, keys.Activate("k2"))
+	current, err := keys.Sign(jwt.MapClaims{"id": 1})
+	require.NoError(t, err)
+
+	token, err := keys.Parse(current, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "k2", token.Header["kid"])
+	_, err = keys.Parse(old, jwt.MapClaims{})
+	assert.NoError(t, err, "未退役的旧密钥签发的token依然有效")
+
+	keys.Retire("k1")
+	_, err = keys.Parse(old, jwt.MapClaims{})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"k2"}, keys.KeyIDs())
+}
+
+func TestKeySetRejectsAlgConfusion(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, publicFile := writeKeyPair(t, dir, "rsa", rsaKey, &rsaKey.PublicKey)
+
+	keys := middlewares.NewKeySet()
+	require.NoError(t, keys.LoadPEM("rsa", "RS256", "", publicFile))
+
+	// 用公开的公钥作为HMAC secret伪造的token
+	publicPEM, err := ioutil.ReadFile(publicFile)
+	require.NoError(t, err)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": 1})
+	forged.Header["kid"] = "rsa"
+	forgedString, err := forged.SignedString(publicPEM)
+	require.NoError(t, err)
+
+	_, err = keys.Parse(forgedString, jwt.MapClaims{})
+	assert.Error(t, err)
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"id": 1}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	_, err = keys.Parse(none, jwt.MapClaims{})
+	assert.Error(t, err)
+}
+
+func TestKeySetConcurrentRetire(t *testing.T) {
+	ks := middlewares.NewKeySet().Add(middlewares.HMACKey("k1", []byte("secret1"))).Add(middlewares.HMACKey("k2", []byte("secret2")))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ks.Retire("k2")
+			ks.Activate("k2")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if token, err := ks.Sign(jwt.StandardClaims{Subject: "1"}); err == nil {
+			ks.Parse(token, &jwt.StandardClaims{})
+		}
+	}
+	<-done
+}
@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+const (
+	lockAdminKey = "Flow @Lock Admin"
+
+	// PushTypeLockRevoked 锁被管理员强制释放时推送给原持有者的Type
+	PushTypeLockRevoked = "lock/revoked"
+)
+
+var _ btypes.Parameter = (*LockAdminParameter)(nil)
+
+type lockAdminPayload struct {
+	TableName string `json:"table_name,omitempty"`
+	ID        uint   `json:"id,omitempty"`
+	Release   bool   `json:"release,omitempty"`
+}
+
+func (p *lockAdminPayload) fromRawMessage(rm json.RawMessage) error {
+	if len(rm) == 0 {
+		return nil
+	}
+	return json.Unmarshal(rm, p)
+}
+
+// LockAdminParameter 查看及强制释放悲观锁，需要 btypes.PermissionLockAdmin
+// 查看: {"table_name": "orders"}，table_name为空时返回所有表的锁
+// 强制释放: {"table_name": "orders", "id": 3, "release": true}
+// 在请求间共用，payload在Call中解析
+type LockAdminParameter struct {
+	pessimisticTables map[string]struct{}
+}
+
+func (*LockAdminParameter) String() string { return lockAdminKey }
+
+// FromRawMessage 只检查payload的格式
+func (*LockAdminParameter) FromRawMessage(_ btypes.Tabler, rm json.RawMessage) error {
+	return new(lockAdminPayload).fromRawMessage(rm)
+}
+func (*LockAdminParameter) Status() btypes.RequestStatus { return btypes.StatusNoop }
+func (*LockAdminParameter) ReadForceUpdate() bool        { return false }
+func (*LockAdminParameter) BuildCacheKey(string) string  { return "" }
+func (*LockAdminParameter) JwtCheck() bool               { return true }
+
+func (pa *LockAdminParameter) Call(c *btypes.Context, _ btypes.Tabler) (result btypes.Result, err error) {
+	if c.Locks == nil {
+		panic("使用了悲观锁，而Locks却是nil，需设置")
+	}
+	var payload lockAdminPayload
+	if err = payload.fromRawMessage(c.Request.Payload); err != nil {
+		return
+	}
+	if _, ok := pa.pessimisticTables[payload.TableName]; payload.TableName != "" && !ok {
+		err = fmt.Errorf("%q 不是悲观锁表", payload.TableName)
+		return
+	}
+
+	if !payload.Release {
+		result.Payloads.Add("locks", c.Locks.Inspect(payload.TableName))
+		return
+	}
+
+	key := btypes.LockKey(payload.TableName, payload.ID)
+	lease, client := c.Locks.ForceRelease(key)
+	if lease == nil {
+		err = fmt.Errorf("%s 未被占用", key)
+		return
+	}
+	c.Logger.Warnf("[audit] 管理员 %d 强制释放了 %s", c.JwtSess.UserID(), lease)
+
+	// 通知原持有者，http请求获取的锁无法通知
+	notified := false
+	if client != nil {
+		notice := &btypes.Response{Type: PushTypeLockRevoked}
+		notice.Add(btypes.Pair{Key: "lease", Value: lease}, btypes.Pair{Key: "by", Value: c.JwtSess.UserID()})
+		notified = client.Push(notice.JSON())
+	}
+
+	result.Payloads.Add("msg", fmt.Sprintf("已强制释放%q写锁", key))
+	result.Payloads.Add("lease", lease)
+	result.Payloads.Add("notified", notified)
+	return
+}
+
+// LockAdminHandler 悲观锁管理，需放在JWTAuthorize及Authorization之后
+func LockAdminHandler(pess map[string]struct{}, actions ...btypes.Action) btypes.ContextConfig {
+	return btypes.HandlerFunc(&btypes.VirtualTable{}, &LockAdminParameter{pessimisticTables: pess}, nil, actions...)
+}
@@ -0,0 +1,177 @@
+package middlewares
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+// LockoutPolicy 登录失败的限制，按账号及远端地址分别计数，记录用SetDurable保存在Cacher中
+// 第k次失败后需等待 BaseDelay*2^(k-1)(不超过MaxDelay)才能再次尝试
+// 连续失败MaxFailures次后锁定LockoutDuration
+type LockoutPolicy struct {
+	MaxFailures     int
+	LockoutDuration time.Duration
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	// Window 失败记录保存的时间，超过后重新计数
+	Window time.Duration
+}
+
+// DefaultLockoutPolicy 失败5次锁定15分钟，之前按1s,2s,4s,8s退避
+var DefaultLockoutPolicy = &LockoutPolicy{
+	MaxFailures:     5,
+	LockoutDuration: 15 * time.Minute,
+	BaseDelay:       time.Second,
+	MaxDelay:        30 * time.Second,
+	Window:          time.Hour,
+}
+
+// Delay 第failures次失败后需要等待的时间，达到MaxFailures时为LockoutDuration
+func (p *LockoutPolicy) Delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	if p.MaxFailures > 0 && failures >= p.MaxFailures {
+		return p.LockoutDuration
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < failures && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// loginFailures 某个账号或地址的失败记录，Last是最近一次尝试的时间
+type loginFailures struct {
+	Count int
+	Until time.Time
+	Last  time.Time
+}
+
+func accountFailureKey(account string) string { return "login/fail/account/" + account }
+func addrFailureKey(addr string) string       { return "login/fail/addr/" + addr }
+
+// loginAttempt 已预留的一次尝试，验证后必须用settle结算
+type loginAttempt struct {
+	cfg     *LogioConfig
+	account string
+	addr    string
+}
+
+func (a *loginAttempt) keys() []string {
+	return []string{accountFailureKey(a.account), addrFailureKey(a.addr)}
+}
+
+// beginAttempt 账号或地址还在等待期内时返回 *btypes.LockedError
+// 否则在验证密码(或验证码)之前原子地预先记为一次失败，
+// 并发的尝试会看到该记录而进入等待期，不能用并发绕过退避
+func (cfg *LogioConfig) beginAttempt(c *btypes.Context, account, addr string) (*loginAttempt, error) {
+	if cfg == nil || cfg.Lockout == nil {
+		return nil, nil
+	}
+	attempt := &loginAttempt{cfg: cfg, account: account, addr: addr}
+
+	cfg.lockoutMu.Lock()
+	defer cfg.lockoutMu.Unlock()
+
+	now := time.Now()
+	for _, key := range attempt.keys() {
+		failures := cfg.loginFailures(c.Cacher, key, now)
+		if now.Before(failures.Until) {
+			c.Logger.Warnf("[audit] 拒绝登录 account=%q addr=%s: %s 失败%d次，锁定至%s",
+				account, addr, key, failures.Count, failures.Until.Format(time.RFC3339))
+			return nil, &btypes.LockedError{RetryAfter: failures.Until.Sub(now)}
+		}
+	}
+	for _, key := range attempt.keys() {
+		failures := cfg.loginFailures(c.Cacher, key, now)
+		failures.Count++
+		failures.Last = now
+		failures.Until = now.Add(cfg.Lockout.Delay(failures.Count))
+		cfg.saveFailures(c.Cacher, key, failures, now)
+	}
+	return attempt, nil
+}
+
+// settle 结算预留的尝试
+// 账号或密码错误、验证码错误时保留该次失败；成功或与凭据无关的错误时撤销预留
+// 成功时不清除账号的记录，完成登录(包括两步验证)后由clearFailures清除
+func (a *loginAttempt) settle(c *btypes.Context, err error) {
+	if a == nil {
+		return
+	}
+	if errors.Is(err, btypes.ErrAccountNotExistOrPasswordNotCorrect) || errors.Is(err, btypes.ErrInvalidTOTP) {
+		if limit := a.cfg.Lockout.MaxFailures; limit > 0 {
+			failures := a.cfg.loginFailures(c.Cacher, accountFailureKey(a.account), time.Now())
+			if failures.Count == limit {
+				c.Logger.Warnf("[audit] 锁定 account=%q addr=%s: 失败%d次，锁定至%s",
+					a.account, a.addr, failures.Count, failures.Until.Format(time.RFC3339))
+			}
+		}
+		return
+	}
+
+	a.cfg.lockoutMu.Lock()
+	defer a.cfg.lockoutMu.Unlock()
+
+	now := time.Now()
+	for _, key := range a.keys() {
+		failures := a.cfg.loginFailures(c.Cacher, key, now)
+		if failures.Count <= 1 {
+			c.Cacher.Remove(key)
+			continue
+		}
+		failures.Count--
+		failures.Until = failures.Last.Add(a.cfg.Lockout.Delay(failures.Count))
+		a.cfg.saveFailures(c.Cacher, key, failures, now)
+	}
+}
+
+// clearFailures 完成登录后清除该账号的记录
+// 地址的记录不清除，避免用一个自己的账号重置计数后再猜测其他账号
+func (cfg *LogioConfig) clearFailures(c *btypes.Context, account string) {
+	if cfg == nil || cfg.Lockout == nil {
+		return
+	}
+	c.Cacher.Remove(accountFailureKey(account))
+}
+
+// loginFailures 超过Window(及等待期)的记录视为不存在，不依赖Cacher支持过期
+func (cfg *LogioConfig) loginFailures(cacher btypes.Cacher, key string, now time.Time) loginFailures {
+	v, ok := cacher.Get(key)
+	if !ok {
+		return loginFailures{}
+	}
+	failures := v.(loginFailures)
+	if now.After(failures.Until) && now.After(failures.Last.Add(cfg.Lockout.Window)) {
+		return loginFailures{}
+	}
+	return failures
+}
+
+func (cfg *LogioConfig) saveFailures(cacher btypes.Cacher, key string, failures loginFailures, now time.Time) {
+	ttl := cfg.Lockout.Window
+	if wait := failures.Until.Sub(now); wait > ttl {
+		ttl = wait
+	}
+	btypes.SetDurable(cacher, key, failures, ttl)
+}
+
+// remoteAddr 客户端地址，websocket时是握手请求的地址
+func remoteAddr(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
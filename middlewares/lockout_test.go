@@ -0,0 +1,182 @@
+package middlewares_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	policy := &middlewares.LockoutPolicy{
+		MaxFailures:     5,
+		LockoutDuration: 15 * time.Minute,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+	}
+
+	assert.Equal(t, time.Duration(0), policy.Delay(0))
+	assert.Equal(t, time.Second, policy.Delay(1))
+	assert.Equal(t, 2*time.Second, policy.Delay(2))
+	// 不超过MaxDelay
+	assert.Equal(t, 3*time.Second, policy.Delay(3))
+	assert.Equal(t, 3*time.Second, policy.Delay(4))
+	assert.Equal(t, 15*time.Minute, policy.Delay(5))
+	assert.Equal(t, 15*time.Minute, policy.Delay(8))
+}
+
+func TestLockedError(t *testing.T) {
+	var err error = &btypes.LockedError{RetryAfter: 1500 * time.Millisecond}
+	wrapped := fmt.Errorf("login: %w", err)
+
+	assert.True(t, errors.Is(wrapped, btypes.ErrAccountLocked))
+	assert.False(t, errors.Is(wrapped, btypes.ErrAccountNotExistOrPasswordNotCorrect))
+
+	resp := btypes.BuildErrorResposeFromRequest(func(string, bool) string { return "login" }, &btypes.Request{}, wrapped)
+	assert.Equal(t, int64(2), resp.Payload["retry_after"])
+}
+
+func TestLockoutConcurrentAttempts(t *testing.T) {
+	gdb, err := gorm.Open(nil, &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+	cacher := cache.New(logger.MultiTargets{})
+	cfg := &middlewares.LogioConfig{Lockout: middlewares.DefaultLockoutPolicy}
+
+	const n = 10
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &btypes.Context{
+				DB:      &btypes.DB{Gorm: gdb},
+				Cacher:  cacher,
+				Logger:  logger.MultiTargets{},
+				HttpReq: &http.Request{RemoteAddr: "10.0.0.1:5000"},
+				Request: &btypes.Request{Type: "users/login", Payload: []byte(`{"account":"alice","password":"guess"}`)},
+			}
+			if err := cfg.LoginHandler(&registerUser{}, nil)(c); err != nil {
+				errs <- err
+				return
+			}
+			_, err := c.Parameter.Call(c, c.Tabler)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// 第一次尝试预留后，其余并发的尝试都在等待期内
+	var failed, locked int
+	for err := range errs {
+		switch {
+		case errors.Is(err, btypes.ErrAccountLocked):
+			locked++
+		case errors.Is(err, btypes.ErrAccountNotExistOrPasswordNotCorrect):
+			failed++
+		default:
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, n-1, locked)
+}
+
+func TestLoginHandlerPerRequestPayload(t *testing.T) {
+	gdb, err := gorm.Open(nil, &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+	cacher := cache.New(logger.MultiTargets{})
+	// 同一个ContextConfig并发处理不同账号的登录
+	config := (&middlewares.LogioConfig{}).LoginHandler(&registerUser{}, nil)
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			account := fmt.Sprintf("user%d", i)
+			c := &btypes.Context{
+				DB:      &btypes.DB{Gorm: gdb},
+				Cacher:  cacher,
+				Logger:  logger.MultiTargets{},
+				HttpReq: &http.Request{RemoteAddr: fmt.Sprintf("10.0.0.%d:5000", i)},
+				Request: &btypes.Request{Type: "users/login", Payload: []byte(fmt.Sprintf(`{"account":%q,"password":"guess"}`, account))},
+			}
+			require.NoError(t, config(c))
+			_, err := c.Parameter.Call(c, c.Tabler)
+			assert.True(t, errors.Is(err, btypes.ErrAccountNotExistOrPasswordNotCorrect))
+			assert.Equal(t, account, c.Tabler.(*registerUser).Account)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// loginSession 登录时由数据库中的用户填充
+type loginSession struct {
+	ID      uint     `json:"id"`
+	Account string   `json:"account"`
+	Role    string   `json:"role"`
+	Roles   []string `json:"roles,omitempty"`
+}
+
+func (*loginSession) New() btypes.JwtSession { return &loginSession{} }
+func (s *loginSession) UserID() uint         { return s.ID }
+
+func TestLoginSessionFromDatabase(t *testing.T) {
+	_, gdb := newUsersDB(t,
+		registerUser{Account: "alice", Password: "alice-pw", Role: "user"},
+		registerUser{Account: "bob", Password: "bob-pw", Role: "admin"})
+	cacher := cache.New(logger.MultiTargets{})
+	cfg := &middlewares.LogioConfig{Expire: time.Hour, Cost: bcrypt.MinCost,
+		Keys: middlewares.NewKeySet().Add(middlewares.HMACKey("", []byte("secret")))}
+	prototype := &loginSession{}
+	config := cfg.LoginHandler(&registerUser{}, prototype)
+	authorize := cfg.Authorize(&loginSession{})
+
+	login := func(payload string) string {
+		c := &btypes.Context{
+			DB:      &btypes.DB{Gorm: gdb},
+			Cacher:  cacher,
+			Logger:  logger.MultiTargets{},
+			HttpReq: &http.Request{RemoteAddr: "10.0.0.1:5000"},
+			Request: &btypes.Request{Type: "users/login", Payload: []byte(payload)},
+		}
+		require.NoError(t, config(c))
+		result, err := c.Parameter.Call(c, c.Tabler)
+		require.NoError(t, err)
+		return result.Payloads[0].Value.(string)
+	}
+
+	// 同一个ContextConfig并发登录，alice伪造了role及roles
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				token := login(`{"account":"alice","password":"alice-pw","role":"admin","roles":["admin"]}`)
+				assert.Equal(t, &loginSession{ID: 1, Account: "alice", Role: "user"}, authorizeHTTP(authorize, cacher, token))
+			} else {
+				token := login(`{"account":"bob","password":"bob-pw"}`)
+				assert.Equal(t, &loginSession{ID: 2, Account: "bob", Role: "admin"}, authorizeHTTP(authorize, cacher, token))
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 共用的原型没有被修改
+	assert.Equal(t, &loginSession{}, prototype)
+}
@@ -6,10 +6,8 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/eruca/bisel/btypes"
 	"github.com/mitchellh/mapstructure"
 	"golang.org/x/crypto/bcrypt"
@@ -33,6 +31,12 @@ type ParamLogio uint8
 const (
 	ParamLogin ParamLogio = iota
 	ParamLogout
+	ParamRefresh
+	ParamRegister
+	ParamChangePassword
+	ParamVerify
+	ParamTOTPEnroll
+	ParamTOTPConfirm
 )
 
 func (p ParamLogio) String() string {
@@ -41,35 +45,84 @@ func (p ParamLogio) String() string {
 		return "Flow @Param Login"
 	case ParamLogout:
 		return "Flow @Param Logout"
+	case ParamRefresh:
+		return "Flow @Param Refresh"
+	case ParamRegister:
+		return "Flow @Param Register"
+	case ParamChangePassword:
+		return "Flow @Param ChangePassword"
+	case ParamVerify:
+		return "Flow @Param Verify"
+	case ParamTOTPEnroll:
+		return "Flow @Param TOTPEnroll"
+	case ParamTOTPConfirm:
+		return "Flow @Param TOTPConfirm"
 	default:
 		panic("should not happened")
 	}
 }
 
+// ParameterLogio 在请求间共用，不保存请求的数据
+// 客户端数据在FromRawMessage中解析到本次请求的tabler(即Context.Tabler)，其他payload在Call中解析到局部变量
 type ParameterLogio struct {
 	ParamLogio `json:"-"`
-	btypes.Tabler
-	salt   string
-	expire int
+	config     *LogioConfig
+	// 用于refresh时产生新的JwtSession
+	jwt btypes.JwtSession
 }
 
+type refreshPayload struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (p *refreshPayload) fromRawMessage(rm json.RawMessage) error {
+	return json.Unmarshal(rm, p)
+}
+
+// payloadDecoder 不解析到tabler的payload
+type payloadDecoder interface {
+	fromRawMessage(json.RawMessage) error
+}
+
+// payload 本次请求的payload，ParamLogin及ParamRegister解析到tabler，返回nil
+func (p *ParameterLogio) payload() payloadDecoder {
+	switch p.ParamLogio {
+	case ParamRefresh:
+		return &refreshPayload{}
+	case ParamChangePassword:
+		return &changePassword{}
+	case ParamVerify, ParamTOTPConfirm:
+		return &totpPayload{}
+	case ParamTOTPEnroll:
+		return &enrollPayload{}
+	default:
+		return nil
+	}
+}
+
+// FromRawMessage 只检查payload的格式，Call时重新解析
 func (p *ParameterLogio) FromRawMessage(tabler btypes.Tabler, rm json.RawMessage) error {
-	err := json.Unmarshal(rm, tabler)
-	if err != nil {
-		return err
+	if payload := p.payload(); payload != nil {
+		return payload.fromRawMessage(rm)
 	}
-	p.Tabler = tabler
-	return nil
+	return json.Unmarshal(rm, tabler)
 }
 
-func (*ParameterLogio) Status() btypes.RequestStatus { return btypes.StatusNoop }
-func (*ParameterLogio) ReadForceUpdate() bool        { return false }
-func (*ParameterLogio) BuildCacheKey(string) string  { return "" }
+func (p *ParameterLogio) Status() btypes.RequestStatus {
+	switch p.ParamLogio {
+	case ParamRegister, ParamChangePassword, ParamTOTPConfirm:
+		return btypes.StatusWrite
+	default:
+		return btypes.StatusNoop
+	}
+}
+func (*ParameterLogio) ReadForceUpdate() bool       { return false }
+func (*ParameterLogio) BuildCacheKey(string) string { return "" }
 func (p *ParameterLogio) JwtCheck() bool {
 	switch p.ParamLogio {
-	case ParamLogin:
+	case ParamLogin, ParamRefresh, ParamRegister, ParamVerify:
 		return false
-	case ParamLogout:
+	case ParamLogout, ParamChangePassword, ParamTOTPEnroll, ParamTOTPConfirm:
 		return true
 	default:
 		return true
@@ -77,32 +130,53 @@ func (p *ParameterLogio) JwtCheck() bool {
 }
 
 func (p *ParameterLogio) Call(c *btypes.Context, tabler btypes.Tabler) (result btypes.Result, err error) {
+	payload := p.payload()
+	if payload != nil {
+		if err = payload.fromRawMessage(c.Request.Payload); err != nil {
+			return
+		}
+	}
+
 	switch p.ParamLogio {
 	case ParamLogin:
+		account := tabler.(Loginer).GetAccount().Value.String()
+		var attempt *loginAttempt
+		if attempt, err = p.config.beginAttempt(c, account, remoteAddr(c.HttpReq)); err != nil {
+			return
+		}
+
 		var loginer btypes.Tabler
 		loginer, err = LoginAssert(c)
+		attempt.settle(c, err)
 		if err == nil {
-			token, err := Generate_jwt(c.JwtSess, p.expire, []byte(p.salt))
-			if err != nil {
-				panic(err)
-			}
-			// 删除密码再返回
-			loginer.(Loginer).DeletePassword()
-			// todo: 是返回给Header还是Payload
-			pess := make([]string, 0, len(c.PessimisticLock))
-			for k := range c.PessimisticLock {
-				pess = append(pess, k)
+			p.config.rehash(c, loginer, tabler.(Loginer).GetPassword().Value.String())
+			// 开启了两步验证，需要再用login/verify完成登录，之前的失败记录在此之后才清除
+			if totpEnabled(loginer) {
+				result.Payloads = p.config.challenge(c, loginer)
+				return
 			}
-
-			pairs := btypes.Pairs{
-				btypes.Pair{Key: "token", Value: token},
-				btypes.Pair{Key: "user", Value: loginer},
-				btypes.Pair{Key: "pess_lock", Value: pess},
-			}
-			result.Payloads = pairs
+			p.config.clearFailures(c, account)
+			result.Payloads = p.config.loginPayloads(c, loginer)
+		}
+	case ParamVerify:
+		var user btypes.Tabler
+		user, err = p.config.verify(c, tabler, payload.(*totpPayload))
+		if err == nil {
+			result.Payloads = p.config.loginPayloads(c, user)
 		}
+	case ParamTOTPEnroll:
+		result.Payloads, err = p.config.enroll(c, tabler, payload.(*enrollPayload))
+	case ParamTOTPConfirm:
+		result.Payloads, err = p.config.confirm(c, tabler, payload.(*totpPayload))
 	case ParamLogout:
+		p.config.logout(c)
 		result.Payloads.Add("msg", "logout success")
+	case ParamRefresh:
+		result.Payloads, err = p.config.refresh(c, payload.(*refreshPayload).RefreshToken, p.jwt.New())
+	case ParamRegister:
+		result.Payloads, err = p.config.register(c, tabler)
+	case ParamChangePassword:
+		result.Payloads, err = p.config.changePassword(c, tabler, payload.(*changePassword))
 	default:
 		panic("should not happened")
 	}
@@ -110,17 +184,55 @@ func (p *ParameterLogio) Call(c *btypes.Context, tabler btypes.Tabler) (result b
 	return
 }
 
-// expire: 默认jwt token过期时间
+// logout 不透明token只删除本次的session，释放该连接持有的悲观锁
+// jwt无法单独撤销，该用户所有已签发的token都失效，释放该用户持有的所有悲观锁
+func (cfg *LogioConfig) logout(c *btypes.Context) {
+	token, opaque := currentOpaqueToken(c)
+	if c.WsClient != nil {
+		c.WsClient.Unbind()
+	}
+
+	if opaque {
+		KillSession(c.Cacher, token)
+		if c.WsClient != nil && c.Locks != nil {
+			c.Locks.ReleaseClient(c.WsClient)
+		}
+		return
+	}
+	if c.JwtSess != nil {
+		RevokeUser(c.Cacher, c.JwtSess.UserID(), cfg.revokeTTL())
+		if c.Locks != nil {
+			c.Locks.ReleaseUser(c.JwtSess.UserID())
+		}
+	}
+}
+
+// loginPayloads 登录成功后返回token(及refresh_token)、删除了密码的用户及悲观锁
+func (cfg *LogioConfig) loginPayloads(c *btypes.Context, user btypes.Tabler) btypes.Pairs {
+	// token及refresh_token
+	pairs := cfg.issueTokens(c, c.JwtSess)
+	// 删除密码再返回
+	user.(Loginer).DeletePassword()
+	// todo: 是返回给Header还是Payload
+	pess := make([]string, 0, len(c.PessimisticLock))
+	for k := range c.PessimisticLock {
+		pess = append(pess, k)
+	}
+
+	pairs.Add("user", user)
+	pairs.Add("pess_lock", pess)
+	return pairs
+}
+
+// expire: 默认jwt token过期时间(小时)，不透明session时是空闲时间
 // salt: jwt添加的salt
-func ConfigLoginHandler(expire int, salt string) func(btypes.Tabler, btypes.JwtSession, ...btypes.Action) btypes.ContextConfig {
-	return func(tabler btypes.Tabler, jwt btypes.JwtSession, actions ...btypes.Action) btypes.ContextConfig {
-		return btypes.HandlerFunc(tabler,
-			&ParameterLogio{
-				ParamLogio: ParamLogin,
-				expire:     expire,
-				salt:       salt,
-			}, jwt, actions...)
+// mode: 可选，SessionOpaque时签发不透明token，JWTAuthorize及LogoutHandler不需要改变
+func ConfigLoginHandler(expire int, salt string, mode ...SessionMode) func(btypes.Tabler, btypes.JwtSession, ...btypes.Action) btypes.ContextConfig {
+	cfg := &LogioConfig{Salt: salt, Expire: time.Duration(expire) * time.Hour}
+	if len(mode) > 0 {
+		cfg.Mode = mode[0]
 	}
+	return cfg.LoginHandler
 }
 
 func LogoutHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
@@ -129,77 +241,81 @@ func LogoutHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.Contex
 
 // todo: JWT CHECK
 func JWTAuthorize(jwt btypes.JwtSession, salt string) btypes.Action {
-	var jwtPool = sync.Pool{
-		New: func() interface{} {
-			return jwt.New()
-		},
-	}
+	return (&LogioConfig{Salt: salt}).Authorize(jwt)
+}
+
+// Authorize 校验access token，token无效、已被撤销或是refresh token时拒绝
+func (cfg *LogioConfig) Authorize(jwt btypes.JwtSession) btypes.Action {
+	cfg.keySet()
 
 	return func(c *btypes.Context) btypes.PairStringer {
-		var token string
 		if !c.Parameter.JwtCheck() {
 			c.Next()
 			return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(fmt.Sprintf("%s 白名单", c.Parameter))}
 		}
-		if c.ConnectionType == btypes.HTTP {
-			if v := c.HttpReq.Header.Get("Authorization"); len(v) > 7 && strings.ToLower(v[:6]) == "bearer" {
-				// 要去掉bearer后面的一个空格，所以时7开始
-				token = v[7:]
-				return parse(c, token, salt, &jwtPool)
+
+		token := requestToken(c)
+		// websocket连接已经认证过，且这次没有带新的token
+		if c.WsClient != nil && token == "" {
+			if bound, ok := c.WsClient.Session().(*wsSession); ok {
+				return cfg.useBoundSession(c, bound)
 			}
 		}
 
-		if c.Request.Token == "" {
+		if token == "" {
 			c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, btypes.ErrInvalidToken)
 			return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(btypes.ErrInvalidToken.Error())}
 		}
-		return parse(c, c.Request.Token, salt, &jwtPool)
+		if isOpaqueToken(token) && c.Cacher != nil {
+			return authorizeOpaque(c, token)
+		}
+		return parse(c, token, cfg, jwt)
 	}
 }
 
-func parse(c *btypes.Context, token, salt string, jwtSessionPool *sync.Pool) btypes.PairStringer {
-	sess := jwtSessionPool.Get().(btypes.JwtSession)
-	err := parseToken(token, sess, []byte(salt))
-	if err != nil {
-		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
-		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(err.Error())}
+// requestToken http请求优先使用Authorization头，其次是Request.Token
+func requestToken(c *btypes.Context) string {
+	if c.ConnectionType == btypes.HTTP {
+		if v := c.HttpReq.Header.Get("Authorization"); len(v) > 7 && strings.ToLower(v[:6]) == "bearer" {
+			// 要去掉bearer后面的一个空格，所以时7开始
+			return v[7:]
+		}
 	}
-	c.JwtSess = sess
-	c.Next()
-
-	jwtSessionPool.Put(sess)
-	return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("JWT authority success")}
+	return c.Request.Token
 }
 
-func parseToken(tokenString string, jwtSession btypes.JwtSession, salt []byte) error {
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) { return salt, nil })
+// parse 每次解码到新的session，不复用: json.Unmarshal不会清除token中没有的字段(比如omitempty的roles)
+func parse(c *btypes.Context, token string, cfg *LogioConfig, jwt btypes.JwtSession) btypes.PairStringer {
+	sess := jwt.New()
+	claims, err := cfg.verifyAccessToken(c.Cacher, token, sess)
 	if err != nil {
-		return btypes.ErrInvalidToken
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
+		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(err.Error())}
 	}
+	c.JwtSess = sess
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		err = mapstructure.Decode(claims, jwtSession)
-		if err != nil {
-			panic(err)
-		}
-		return nil
+	// websocket连接的第一次认证(或带来了新的token)，之后的请求都使用该session
+	if c.WsClient != nil {
+		bindClient(c.WsClient, sess, claims)
+		c.Next()
+		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("JWT authority success, bind websocket")}
 	}
-	return btypes.ErrInvalidToken
+	c.Next()
+	return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("JWT authority success")}
 }
 
 func LoginAssert(c *btypes.Context) (btypes.Tabler, error) {
-	param, ok := c.Parameter.(*ParameterLogio)
-	if !ok {
+	if _, ok := c.Parameter.(*ParameterLogio); !ok {
 		panic("Parameter 不是 *Param")
 	}
 
-	// 来之客户端的数据
-	loginer, ok := param.Tabler.(Loginer)
+	// 来之客户端的数据，Parameter在请求间共用，使用本次请求的Tabler
+	loginer, ok := c.Tabler.(Loginer)
 	if !ok {
 		panic("loginer 必须实现 Loginer 接口")
 	}
 	// 作为登录成功后数据的接收者
-	tabler := param.Tabler.New()
+	tabler := c.Tabler.New()
 
 	account := loginer.GetAccount()
 	password := loginer.GetPassword()
@@ -227,21 +343,27 @@ func LoginAssert(c *btypes.Context) (btypes.Tabler, error) {
 		return tabler, nil
 	}
 
-	if err := mapstructure.Decode(loginer, c.JwtSess); err != nil {
+	// c.JwtSess是在请求间共用的原型，只作New用
+	// session只来自数据库中的用户，客户端提交的其他字段(比如id、roles)不会被签名
+	// 平铺嵌入的btypes.GormModel，session的ID才是用户的ID
+	sess := c.JwtSess.New()
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{Squash: true, Result: sess})
+	if err == nil {
+		err = decoder.Decode(tabler)
+	}
+	if err != nil {
 		c.Logger.Errorf("将登录用户转码值jwtSession时发生错误: %s", err.Error())
 		panic("mapstructure.Decode(loginer,jwtSession) failed")
 	}
+	c.JwtSess = sess
 	return tabler, nil
 }
 
 // 登录成功后产生的jwt返回给客户端
 // todo: 1. 写在header() 2.写在payload里
 func Generate_jwt(jwtSession btypes.JwtSession, expire int, salt []byte) (string, error) {
-	sess := btypes.Struct2Map(jwtSession)
-	sess["exp"] = time.Now().Add(time.Duration(expire) * time.Hour).Unix()
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims(sess))
-	return token.SignedString(salt)
+	cfg := &LogioConfig{Keys: NewKeySet().Add(HMACKey("", salt))}
+	return cfg.signToken(jwtSession, tokenAccess, 0, time.Duration(expire)*time.Hour)
 }
 
 func Struct2Map(obj interface{}) map[string]interface{} {
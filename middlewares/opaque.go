@@ -0,0 +1,130 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/ws"
+)
+
+// SessionMode 登录后签发的token的类型
+type SessionMode uint8
+
+const (
+	// SessionJWT 签名的jwt，session数据在token中
+	SessionJWT SessionMode = iota
+	// SessionOpaque 随机的不透明token，session数据保存在Cacher中，每次使用后延长有效期
+	// 可以用KillSession立即使其失效，客户端也看不到session的内容
+	// 只影响签发，Authorize及LogoutHandler按token的形式同时支持两种
+	SessionOpaque
+)
+
+// 未配置Expire时不透明session的空闲时间
+const defaultSessionIdle = 30 * time.Minute
+
+// opaqueSession Cacher中保存的session，gen用于RevokeUser
+// idle是签发时配置的空闲时间，校验时不依赖Authorize的配置
+type opaqueSession struct {
+	sess btypes.JwtSession
+	gen  int64
+	idle time.Duration
+}
+
+func opaqueSessionKey(token string) string { return "session/" + token }
+
+// isOpaqueToken 不透明token是hex，jwt由"."分成三段
+func isOpaqueToken(token string) bool { return token != "" && !strings.Contains(token, ".") }
+
+// KillSession 立即使该不透明token失效
+func KillSession(cacher btypes.Cacher, token string) bool {
+	return cacher.Remove(opaqueSessionKey(token))
+}
+
+func (cfg *LogioConfig) sessionIdle() time.Duration {
+	if cfg.Expire <= 0 {
+		return defaultSessionIdle
+	}
+	return cfg.Expire
+}
+
+// issueOpaque 用SetDurable保存sess的副本，不会因Cacher容量被淘汰，返回随机token
+func (cfg *LogioConfig) issueOpaque(c *btypes.Context, sess btypes.JwtSession) (string, *opaqueSession) {
+	mustCacher(c.Cacher)
+
+	token := newTokenID() + newTokenID()
+	record := &opaqueSession{sess: copySession(sess), gen: tokenGeneration(c.Cacher, sess.UserID()), idle: cfg.sessionIdle()}
+	btypes.SetDurable(c.Cacher, opaqueSessionKey(token), record, record.idle)
+	return token, record
+}
+
+// loadOpaque 按token加载session并延长有效期，不存在、过期或已被RevokeUser时返回ErrInvalidToken
+func loadOpaque(cacher btypes.Cacher, token string) (*opaqueSession, error) {
+	mustCacher(cacher)
+
+	key := opaqueSessionKey(token)
+	v, ok := cacher.Get(key)
+	if !ok {
+		return nil, btypes.ErrInvalidToken
+	}
+	record := v.(*opaqueSession)
+	if isTokenRevoked(cacher, record.sess.UserID(), record.gen, "") {
+		cacher.Remove(key)
+		return nil, btypes.ErrInvalidToken
+	}
+	btypes.SetDurable(cacher, key, record, record.idle)
+	return record, nil
+}
+
+// authorizeOpaque 不透明token的Authorize
+func authorizeOpaque(c *btypes.Context, token string) btypes.PairStringer {
+	record, err := loadOpaque(c.Cacher, token)
+	if err != nil {
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
+		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(err.Error())}
+	}
+	c.JwtSess = record.sess
+	if c.WsClient != nil {
+		bindOpaque(c.WsClient, token, record)
+	}
+
+	c.Next()
+	return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("opaque session")}
+}
+
+// bindOpaque 绑定到websocket连接，空闲时间到后关闭连接
+func bindOpaque(client *ws.Client, token string, record *opaqueSession) {
+	bound := &wsSession{JwtSession: record.sess, gen: record.gen, jti: token, opaque: true}
+	client.Bind(bound, record.sess.UserID(), time.Now().Add(record.idle))
+}
+
+// currentOpaqueToken 本次请求使用的不透明token，websocket上可以是绑定的token
+func currentOpaqueToken(c *btypes.Context) (string, bool) {
+	token := requestToken(c)
+	if token == "" && c.WsClient != nil {
+		if bound, ok := c.WsClient.Session().(*wsSession); ok && bound.opaque {
+			token = bound.jti
+		}
+	}
+	return token, isOpaqueToken(token)
+}
+
+// copySession 按json复制一份，保存的session不与请求中的共用
+func copySession(sess btypes.JwtSession) btypes.JwtSession {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		panic(err)
+	}
+	cp := sess.New()
+	if err = json.Unmarshal(data, cp); err != nil {
+		panic(err)
+	}
+	return cp
+}
+
+func mustCacher(cacher btypes.Cacher) {
+	if cacher == nil {
+		panic("使用了不透明session，而cacher却是nil，需设置")
+	}
+}
@@ -0,0 +1,74 @@
+package middlewares_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestOpaqueSession(t *testing.T) {
+	_, gdb := newUsersDB(t, registerUser{Account: "alice", Password: "alice-pw", Role: "user"})
+	cacher := cache.New(logger.MultiTargets{})
+	const idle = 300 * time.Millisecond
+	cfg := &middlewares.LogioConfig{Mode: middlewares.SessionOpaque, Expire: idle, Cost: bcrypt.MinCost}
+	authorize := cfg.Authorize(&loginSession{})
+
+	login := func() string {
+		c := &btypes.Context{
+			DB:      &btypes.DB{Gorm: gdb},
+			Cacher:  cacher,
+			Logger:  logger.MultiTargets{},
+			HttpReq: &http.Request{RemoteAddr: "10.0.0.1:5000"},
+			Request: &btypes.Request{Type: "users/login", Payload: []byte(`{"account":"alice","password":"alice-pw"}`)},
+		}
+		require.NoError(t, cfg.LoginHandler(&registerUser{}, &loginSession{})(c))
+		result, err := c.Parameter.Call(c, c.Tabler)
+		require.NoError(t, err)
+		return result.Payloads[0].Value.(string)
+	}
+
+	// Authorize按token从Cacher加载session
+	token := login()
+	assert.NotContains(t, token, ".")
+	assert.Equal(t, &loginSession{ID: 1, Account: "alice", Role: "user"}, authorizeHTTP(authorize, cacher, token))
+	assert.Nil(t, authorizeHTTP(authorize, cacher, token+"0"))
+
+	// 每次使用后延长空闲时间，总时长可以超过idle
+	for i := 0; i < 3; i++ {
+		time.Sleep(idle / 2)
+		require.NotNil(t, authorizeHTTP(authorize, cacher, token), "use %d", i)
+	}
+	// 空闲超过idle后失效
+	time.Sleep(idle + idle/2)
+	assert.Nil(t, authorizeHTTP(authorize, cacher, token))
+
+	// 登出只使本次的token失效
+	token, other := login(), login()
+	req := httptest.NewRequest("POST", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	c := &btypes.Context{
+		ConnectionType: btypes.HTTP,
+		Cacher:         cacher,
+		Logger:         logger.MultiTargets{},
+		HttpReq:        req,
+		Request:        &btypes.Request{Type: "users/logout", Payload: []byte(`{}`)},
+	}
+	require.NoError(t, cfg.LogoutHandler(&registerUser{})(c))
+	_, err := c.Parameter.Call(c, c.Tabler)
+	require.NoError(t, err)
+	assert.Nil(t, authorizeHTTP(authorize, cacher, token))
+	assert.NotNil(t, authorizeHTTP(authorize, cacher, other))
+
+	// RevokeUser使该用户所有的session失效
+	middlewares.RevokeUser(cacher, 1, time.Hour)
+	assert.Nil(t, authorizeHTTP(authorize, cacher, other))
+}
@@ -0,0 +1,236 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/eruca/bisel/btypes"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// PasswordSetter 注册、修改密码时，用它把hash后的密码写回tabler
+type PasswordSetter interface {
+	SetPassword(hashed string)
+}
+
+// RegisterFielder 可选，注册时除账号及密码外允许客户端设置的列(比如昵称)
+// 其他列(id、version、角色等)一律不从客户端复制，保持零值或数据库默认值
+type RegisterFielder interface {
+	RegisterFields() []string
+}
+
+// PasswordPolicy 密码强度策略，nil表示不检查
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// Check 不符合策略时返回的error包含 btypes.ErrWeakPassword
+func (p *PasswordPolicy) Check(password string) error {
+	if p == nil {
+		return nil
+	}
+
+	var missing []string
+	if len([]rune(password)) < p.MinLength {
+		missing = append(missing, fmt.Sprintf("至少%d位", p.MinLength))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		missing = append(missing, "大写字母")
+	}
+	if p.RequireLower && !lower {
+		missing = append(missing, "小写字母")
+	}
+	if p.RequireDigit && !digit {
+		missing = append(missing, "数字")
+	}
+	if p.RequireSymbol && !symbol {
+		missing = append(missing, "符号")
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: 需要%s", btypes.ErrWeakPassword, strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// bcryptCost 未配置Cost时使用bcrypt.DefaultCost
+func (cfg *LogioConfig) bcryptCost() int {
+	if cfg == nil || cfg.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return cfg.Cost
+}
+
+// HashPassword 按密码策略检查后，用配置的cost进行bcrypt
+func (cfg *LogioConfig) HashPassword(password string) (string, error) {
+	if cfg != nil {
+		if err := cfg.Policy.Check(password); err != nil {
+			return "", err
+		}
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), cfg.bcryptCost())
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// RegisterHandler 注册，tabler需实现 Loginer 及 PasswordSetter
+// 密码按策略检查并hash后插入，账号已存在时返回 btypes.ErrAccountExists
+func (cfg *LogioConfig) RegisterHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
+	mustPasswordSetter(tabler)
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamRegister, config: cfg}, nil, actions...)
+}
+
+// ChangePasswordHandler 修改当前登录用户的密码，需要验证旧密码，成功后该用户之前的token都失效
+// payload: {"old_password": "...", "new_password": "..."}
+// 返回新的token(及refresh_token)，当前客户端不需要重新登录
+func (cfg *LogioConfig) ChangePasswordHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
+	mustPasswordSetter(tabler)
+	cfg.keySet()
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamChangePassword, config: cfg}, nil, actions...)
+}
+
+func mustPasswordSetter(tabler btypes.Tabler) {
+	if _, ok := tabler.(Loginer); !ok {
+		panic("tabler 必须实现 Loginer 接口")
+	}
+	if _, ok := tabler.(PasswordSetter); !ok {
+		panic("tabler 必须实现 PasswordSetter 接口")
+	}
+}
+
+type changePassword struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+func (p *changePassword) fromRawMessage(rm json.RawMessage) error {
+	return json.Unmarshal(rm, p)
+}
+
+// register 插入新用户，返回删除了密码的用户
+// 只把账号、密码及RegisterFields从客户端数据复制到新的tabler，客户端不能设置其他列
+func (cfg *LogioConfig) register(c *btypes.Context, payload btypes.Tabler) (btypes.Pairs, error) {
+	account, password := payload.(Loginer).GetAccount(), payload.(Loginer).GetPassword()
+	hashed, err := cfg.HashPassword(password.Value.String())
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{account.Key}
+	if fielder, ok := payload.(RegisterFielder); ok {
+		columns = append(columns, fielder.RegisterFields()...)
+	}
+	tabler := payload.New()
+	if err := copyColumns(c.DB.Gorm, tabler, payload, columns); err != nil {
+		panic(err)
+	}
+	tabler.(PasswordSetter).SetPassword(hashed)
+	loginer := tabler.(Loginer)
+
+	if err := c.DB.Gorm.Create(tabler).Error; err != nil {
+		if strings.Contains(err.Error(), btypes.ErrStringUniqueConstrait) {
+			return nil, btypes.ErrAccountExists
+		}
+		panic(err)
+	}
+	loginer.DeletePassword()
+
+	var pairs btypes.Pairs
+	pairs.Add("user", tabler)
+	return pairs, nil
+}
+
+// copyColumns 把src中columns(列名或字段名)对应的字段复制到dst
+func copyColumns(db *gorm.DB, dst, src btypes.Tabler, columns []string) error {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(src); err != nil {
+		return err
+	}
+	from, to := reflect.Indirect(reflect.ValueOf(src)), reflect.Indirect(reflect.ValueOf(dst))
+	for _, column := range columns {
+		field := stmt.Schema.LookUpField(column)
+		if field == nil {
+			return fmt.Errorf("%s 没有列 %q", stmt.Schema.Table, column)
+		}
+		value, _ := field.ValueOf(from)
+		if err := field.Set(to, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changePassword 验证旧密码，更新为新密码，撤销该用户所有的token并签发新的
+func (cfg *LogioConfig) changePassword(c *btypes.Context, tabler btypes.Tabler, cp *changePassword) (btypes.Pairs, error) {
+	userID := c.JwtSess.UserID()
+	user := tabler.New()
+	if err := c.DB.Gorm.Model(user).Where("id = ?", userID).First(user).Error; err != nil {
+		c.Logger.Errorf("修改密码时，查找用户 %d 发生错误: %s", userID, err.Error())
+		return nil, btypes.ErrAccountNotExistOrPasswordNotCorrect
+	}
+
+	// 旧密码的失败与登录一样计入该账号及地址的退避及锁定
+	account := user.(Loginer).GetAccount().Value.String()
+	attempt, err := cfg.beginAttempt(c, account, remoteAddr(c.HttpReq))
+	if err != nil {
+		return nil, err
+	}
+	password := user.(Loginer).GetPassword()
+	if bcrypt.CompareHashAndPassword([]byte(password.Value.String()), []byte(cp.OldPassword)) != nil {
+		attempt.settle(c, btypes.ErrAccountNotExistOrPasswordNotCorrect)
+		c.Logger.Warnf("[audit] 用户 %d 修改密码时旧密码错误", userID)
+		return nil, btypes.ErrAccountNotExistOrPasswordNotCorrect
+	}
+	attempt.settle(c, nil)
+
+	hashed, err := cfg.HashPassword(cp.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+	updateColumns(c, user, map[string]interface{}{password.Key: hashed})
+
+	RevokeUser(c.Cacher, userID, cfg.revokeTTL())
+	return cfg.issueTokens(c, c.JwtSess), nil
+}
+
+// rehash 登录成功后，如果数据库中的hash的cost与配置的不一致，用明文密码重新hash
+// 修改了Cost后，用户再次登录时逐步迁移
+func (cfg *LogioConfig) rehash(c *btypes.Context, user btypes.Tabler, plain string) {
+	password := user.(Loginer).GetPassword()
+	cost, err := bcrypt.Cost([]byte(password.Value.String()))
+	if err != nil || cost == cfg.bcryptCost() {
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(plain), cfg.bcryptCost())
+	if err != nil {
+		c.Logger.Errorf("rehash 用户 %d 的密码失败: %s", user.Model().ID, err.Error())
+		return
+	}
+	updateColumns(c, user, map[string]interface{}{password.Key: string(hashed)})
+	c.Logger.Infof("用户 %d 的密码cost由 %d 迁移到 %d", user.Model().ID, cost, cfg.bcryptCost())
+}
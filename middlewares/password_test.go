@@ -0,0 +1,128 @@
+package middlewares_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &middlewares.PasswordPolicy{MinLength: 8, RequireUpper: true, RequireDigit: true, RequireSymbol: true}
+
+	for _, weak := range []string{"Ab1!", "abcdefg1!", "Abcdefgh!", "Abcdefgh1"} {
+		err := policy.Check(weak)
+		assert.True(t, errors.Is(err, btypes.ErrWeakPassword), weak)
+	}
+	assert.NoError(t, policy.Check("Abcdefg1!"))
+
+	var none *middlewares.PasswordPolicy
+	assert.NoError(t, none.Check(""))
+}
+
+func TestHashPasswordCost(t *testing.T) {
+	cfg := &middlewares.LogioConfig{Cost: bcrypt.MinCost, Policy: &middlewares.PasswordPolicy{MinLength: 6}}
+
+	_, err := cfg.HashPassword("short")
+	assert.True(t, errors.Is(err, btypes.ErrWeakPassword))
+
+	hashed, err := cfg.HashPassword("long enough")
+	require.NoError(t, err)
+	cost, err := bcrypt.Cost([]byte(hashed))
+	require.NoError(t, err)
+	assert.Equal(t, bcrypt.MinCost, cost)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hashed), []byte("long enough")))
+}
+
+type registerUser struct {
+	btypes.GormModel
+	Account  string `json:"account"`
+	Password string `json:"password,omitempty"`
+	Nickname string `json:"nickname"`
+	Role     string `json:"role"`
+}
+
+func (*registerUser) New() btypes.Tabler                       { return &registerUser{} }
+func (*registerUser) TableName() string                        { return "users" }
+func (*registerUser) Register(map[string]btypes.ContextConfig) {}
+func (u *registerUser) GetAccount() btypes.PairStringer {
+	return btypes.PairStringer{Key: "account", Value: btypes.ValueString(u.Account)}
+}
+func (u *registerUser) GetPassword() btypes.PairStringer {
+	return btypes.PairStringer{Key: "password", Value: btypes.ValueString(u.Password)}
+}
+func (u *registerUser) DeletePassword()           { u.Password = "" }
+func (u *registerUser) SetPassword(hashed string) { u.Password = hashed }
+func (*registerUser) RegisterFields() []string    { return []string{"nickname"} }
+func (*registerUser) QueryOmits() []string        { return nil }
+func (*registerUser) Depends() []string           { return nil }
+func (*registerUser) PessimisticLock() bool       { return false }
+
+func TestRegisterIgnoresServerColumns(t *testing.T) {
+	gdb, err := gorm.Open(nil, &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+
+	cfg := &middlewares.LogioConfig{Cost: bcrypt.MinCost}
+	c := &btypes.Context{
+		DB: &btypes.DB{Gorm: gdb},
+		Request: &btypes.Request{Type: "users/register", Payload: []byte(
+			`{"id":99,"version":7,"account":"alice","password":"secret","nickname":"A","role":"admin"}`)},
+	}
+	require.NoError(t, cfg.RegisterHandler(&registerUser{})(c))
+
+	result, err := c.Parameter.Call(c, c.Tabler)
+	require.NoError(t, err)
+	user := result.Payloads[0].Value.(*registerUser)
+	assert.Equal(t, "alice", user.Account)
+	assert.Equal(t, "A", user.Nickname)
+	assert.Empty(t, user.Role)
+	assert.Zero(t, user.ID)
+	assert.Zero(t, user.Version)
+	assert.Empty(t, user.Password)
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	users, gdb := newUsersDB(t, registerUser{Account: "alice", Password: "old-pw"})
+	cacher := cache.New(logger.MultiTargets{})
+	cfg := &middlewares.LogioConfig{Lockout: middlewares.DefaultLockoutPolicy, Expire: time.Hour, Cost: bcrypt.MinCost}
+
+	call := func(config btypes.ContextConfig, typ, payload string) error {
+		c := &btypes.Context{
+			DB:      &btypes.DB{Gorm: gdb},
+			Cacher:  cacher,
+			Logger:  logger.MultiTargets{},
+			JwtSess: &claimsSession{ID: 1},
+			HttpReq: &http.Request{RemoteAddr: "10.0.0.1:5000"},
+			Request: &btypes.Request{Type: typ, Payload: []byte(payload)},
+		}
+		require.NoError(t, config(c))
+		_, err := c.Parameter.Call(c, c.Tabler)
+		return err
+	}
+	change := func(old string) error {
+		return call(cfg.ChangePasswordHandler(&registerUser{}), "users/change_password",
+			fmt.Sprintf(`{"old_password":%q,"new_password":"new-pw"}`, old))
+	}
+
+	// 旧密码错误计入该账号的退避，等待期内正确的旧密码及登录都被拒绝
+	assert.True(t, errors.Is(change("guess"), btypes.ErrAccountNotExistOrPasswordNotCorrect))
+	assert.True(t, errors.Is(change("old-pw"), btypes.ErrAccountLocked))
+	login := cfg.LoginHandler(&registerUser{}, nil)
+	assert.True(t, errors.Is(call(login, "users/login", `{"account":"alice","password":"old-pw"}`), btypes.ErrAccountLocked))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(users.password(1)), []byte("old-pw")))
+
+	// 等待期过后可以修改
+	time.Sleep(middlewares.DefaultLockoutPolicy.BaseDelay)
+	require.NoError(t, change("old-pw"))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(users.password(1)), []byte("new-pw")))
+}
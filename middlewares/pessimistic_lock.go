@@ -3,29 +3,44 @@ package middlewares
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/eruca/bisel/btypes"
 )
 
-const pessimisticLockKey = "Flow @Pessimistic Lock"
+const (
+	pessimisticLockKey = "Flow @Pessimistic Lock"
+
+	// DefaultLockTTL 悲观锁租约的默认时长
+	DefaultLockTTL = 5 * time.Minute
+	// PushTypeLockExpiring 租约快到期时推送给持有者(websocket)的Type
+	PushTypeLockExpiring = "lock/expiring"
+)
 
 var _ btypes.Parameter = (*PessimisticLockParameter)(nil)
 
+type pessimisticLockPayload struct {
+	TableName string `json:"table_name,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	Lock      bool   `json:"lock,omitempty"`
+	// Renew 续租，只有持有者可以续租
+	Renew bool `json:"renew,omitempty"`
+}
+
+// PessimisticLockParameter 上锁、续租及解锁，持有者是当前登录的用户
+// 只有持有者或拥有 btypes.PermissionLockOverride 权限的用户可以解锁
+// payload: {"table_name": "orders", "id": 3, "lock": true} 或 "renew": true，都没有时解锁
+// 在请求间共用，payload在Call中解析
 type PessimisticLockParameter struct {
-	TableName         string `json:"table_name,omitempty"`
-	ID                int    `json:"id,omitempty"`
-	UserID            int    `json:"user_id,omitempty"`
-	Lock              bool   `json:"lock,omitempty"`
 	pessimisticTables map[string]struct{}
+	ttl               time.Duration
 }
 
 func (*PessimisticLockParameter) String() string { return pessimisticLockKey }
-func (pl *PessimisticLockParameter) FromRawMessage(_ btypes.Tabler, rm json.RawMessage) error {
-	err := json.Unmarshal(rm, pl)
-	if err != nil {
-		return err
-	}
-	return nil
+
+// FromRawMessage 只检查payload的格式
+func (*PessimisticLockParameter) FromRawMessage(_ btypes.Tabler, rm json.RawMessage) error {
+	return json.Unmarshal(rm, new(pessimisticLockPayload))
 }
 func (*PessimisticLockParameter) Status() btypes.RequestStatus { return btypes.StatusNoop }
 func (*PessimisticLockParameter) ReadForceUpdate() bool        { return false }
@@ -34,39 +49,101 @@ func (*PessimisticLockParameter) JwtCheck() bool               { return true }
 
 // c.Tabler == VirtualTable
 func (pl *PessimisticLockParameter) Call(c *btypes.Context, _ btypes.Tabler) (result btypes.Result, err error) {
+	var payload pessimisticLockPayload
+	if err = json.Unmarshal(c.Request.Payload, &payload); err != nil {
+		return
+	}
 	// 如果Tabler已经设置为乐观锁，直接返回成功
-	if _, ok := pl.pessimisticTables[pl.TableName]; !ok {
+	if _, ok := pl.pessimisticTables[payload.TableName]; !ok {
 		return
 	}
-	c.Logger.Warnf("RemoteAddr: %q", c.HttpReq.RemoteAddr)
-
-	key := fmt.Sprintf("%s/%d", pl.TableName, pl.ID)
-	userid, ok := c.Cacher.Get(key)
-	if !ok {
-		if pl.Lock {
-			result.Payloads.Add("msg", fmt.Sprintf("已获取%q写锁", key))
-			c.Logger.Infof("%d: 获取%s", pl.UserID, key)
-
-			c.Cacher.Set(key, pl.UserID)
-			c.Cacher.Set(pl.UserID, key)
-		} else {
+	if c.JwtSess == nil {
+		panic("悲观锁需要JwtSession，需放在JWTAuthorize之后")
+	}
+	if c.Locks == nil {
+		panic("使用了悲观锁，而Locks却是nil，需设置")
+	}
+
+	key := btypes.LockKey(payload.TableName, uint(payload.ID))
+	userID := c.JwtSess.UserID()
+
+	switch {
+	case payload.Renew:
+		var lease *btypes.LockLease
+		if lease, err = c.Locks.Renew(key, c.JwtSess, c.WsClient, pl.ttl); err != nil {
+			c.Logger.Warnf("%d: %s", userID, err)
+			return
+		}
+		pl.noticeExpiring(c, lease)
+		result.Payloads.Add("msg", fmt.Sprintf("已续租%q写锁", key))
+		result.Payloads.Add("lease", lease)
+		c.Logger.Infof("%s，续租至%s", lease, lease.Expires.Format(time.RFC3339))
+
+	case payload.Lock:
+		var lease *btypes.LockLease
+		if lease, err = c.Locks.Acquire(key, c.JwtSess, c.WsClient, pl.ttl); err != nil {
+			c.Logger.Warnf("%d: %s", userID, err)
+			return
+		}
+		pl.noticeExpiring(c, lease)
+		result.Payloads.Add("msg", fmt.Sprintf("已获取%q写锁", key))
+		result.Payloads.Add("lease", lease)
+		c.Logger.Infof("%s，至%s", lease, lease.Expires.Format(time.RFC3339))
+
+	default:
+		lease := c.Locks.Get(key)
+		if lease == nil {
 			err = fmt.Errorf("%s 未被占用，现在却是要求解锁，你那里写错了", key)
 			c.Logger.Errorf(err.Error())
+			return
 		}
-	} else {
-		if pl.Lock {
-			err = fmt.Errorf("%s 已被 %d 占用，现在却是要求上锁，你哪里写错了", key, userid)
-			c.Logger.Errorf(err.Error())
-		} else {
-			c.Cacher.Remove(key)
-			c.Cacher.Remove(userid)
-			result.Payloads.Add("msg", fmt.Sprintf("删除%q写锁", key))
-			c.Logger.Infof("%d: 删除%q", pl.UserID, key)
+		if lease.UserID != userID {
+			if c.AccessControl == nil || !c.AccessControl.Allowed(c.JwtSess, btypes.PermissionLockOverride) {
+				err = &btypes.ForbiddenError{Router: c.Request.Type, Permission: btypes.PermissionLockOverride}
+				c.Logger.Warnf("%d 解锁 %s: %s", userID, lease, err)
+				return
+			}
+			c.Logger.Warnf("[audit] %d 解除了 %s", userID, lease)
 		}
+		c.Locks.Release(key)
+		result.Payloads.Add("msg", fmt.Sprintf("删除%q写锁", key))
+		result.Payloads.Add("lease", lease)
+		c.Logger.Infof("%d: 删除%q", userID, key)
 	}
 	return
 }
 
+// noticeExpiring websocket连接持有时，在到期前(剩余1/5时)推送提醒
+func (pl *PessimisticLockParameter) noticeExpiring(c *btypes.Context, lease *btypes.LockLease) {
+	client := c.WsClient
+	if client == nil {
+		return
+	}
+	locks, logger := c.Locks, c.Logger
+	time.AfterFunc(pl.ttl-pl.ttl/5, func() {
+		// 已经续租或解锁
+		if locks.Get(lease.Key) != lease {
+			return
+		}
+		notice := &btypes.Response{Type: PushTypeLockExpiring}
+		notice.Add(btypes.Pair{Key: "lease", Value: lease})
+		if !client.Push(notice.JSON()) {
+			logger.Warnf("租约快到期，通知失败: %s", lease)
+		}
+	})
+}
+
+// PessimisticLockHandler 使用默认的租约时长
 func PessimisticLockHandler(pess map[string]struct{}, actions ...btypes.Action) btypes.ContextConfig {
-	return btypes.HandlerFunc(&btypes.VirtualTable{}, &PessimisticLockParameter{pessimisticTables: pess}, nil, actions...)
+	return ConfigPessimisticLockHandler(pess, DefaultLockTTL, actions...)
+}
+
+// ConfigPessimisticLockHandler 上锁、续租及解锁
+// ttl: 租约时长，持有者需在到期前续租，否则自动释放
+func ConfigPessimisticLockHandler(pess map[string]struct{}, ttl time.Duration, actions ...btypes.Action) btypes.ContextConfig {
+	if ttl <= 0 {
+		panic("悲观锁租约时长必须大于0")
+	}
+	return btypes.HandlerFunc(&btypes.VirtualTable{},
+		&PessimisticLockParameter{pessimisticTables: pess, ttl: ttl}, nil, actions...)
 }
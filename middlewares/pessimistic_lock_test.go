@@ -0,0 +1,49 @@
+package middlewares_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPessimisticLockConcurrentRequests(t *testing.T) {
+	locks := btypes.NewLockRegistry(0)
+	// 同一个ContextConfig并发处理不同用户对不同行的上锁
+	config := middlewares.ConfigPessimisticLockHandler(map[string]struct{}{"orders": {}}, time.Minute)
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &btypes.Context{
+				Logger:  logger.MultiTargets{},
+				Locks:   locks,
+				JwtSess: &claimsSession{ID: uint(i)},
+				Request: &btypes.Request{Type: "lock", Payload: []byte(fmt.Sprintf(`{"table_name":"orders","id":%d,"lock":true}`, i))},
+			}
+			require.NoError(t, config(c))
+			result, err := c.Parameter.Call(c, c.Tabler)
+			require.NoError(t, err)
+			lease := result.Payloads[1].Value.(*btypes.LockLease)
+			assert.Equal(t, btypes.LockKey("orders", uint(i)), lease.Key)
+			assert.Equal(t, uint(i), lease.UserID)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 1; i <= n; i++ {
+		lease := locks.Get(btypes.LockKey("orders", uint(i)))
+		if assert.NotNil(t, lease, "orders/%d", i) {
+			assert.Equal(t, uint(i), lease.UserID)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package middlewares
+
+import (
+	"fmt"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+const authorizationKey = "Flow @Authorization"
+
+// Authorization 按照AccessControl检查session是否拥有该路由需要的权限
+// 需要放在JWTAuthorize之后，没有权限时返回*btypes.ForbiddenError
+func Authorization(c *btypes.Context) btypes.PairStringer {
+	if c.AccessControl == nil {
+		panic("使用了Authorization，而AccessControl却是nil，需设置")
+	}
+
+	if err := c.AccessControl.Authorize(c.JwtSess, c.Request.Type); err != nil {
+		c.Logger.Warnf("%s", err)
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
+		return btypes.PairStringer{Key: authorizationKey, Value: btypes.ValueString(err.Error())}
+	}
+
+	c.Next()
+	return btypes.PairStringer{
+		Key:   authorizationKey,
+		Value: btypes.ValueString(fmt.Sprintf("%s 权限: %q", c.Request.Type, c.AccessControl.Permission(c.Request.Type))),
+	}
+}
@@ -0,0 +1,223 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+const (
+	tokenAccess  = "access"
+	tokenRefresh = "refresh"
+
+	// 未配置时，撤销记录保存的时间，应不短于token的有效期
+	defaultRevokeTTL = 30 * 24 * time.Hour
+)
+
+// LogioConfig 登录、登出、刷新token及JWT校验的配置
+type LogioConfig struct {
+	// Mode 签发jwt还是不透明token
+	Mode SessionMode
+	// Salt jwt签名用的salt，Keys为空时使用HS256
+	Salt string
+	// Keys 签名密钥集合，支持RS256/ES256/EdDSA及按kid轮换
+	Keys     *KeySet
+	keysOnce sync.Once
+	// Expire access token的有效期，不透明session时是空闲时间
+	Expire time.Duration
+	// RefreshExpire refresh token的有效期，为0时不签发refresh token
+	RefreshExpire time.Duration
+	// Cost bcrypt的cost，为0时使用bcrypt.DefaultCost
+	// 修改后，已有用户在下次登录时rehash
+	Cost int
+	// Policy 注册及修改密码时的密码强度策略
+	Policy *PasswordPolicy
+	// Issuer、Audience 写入iss及aud，不为空时校验
+	Issuer   string
+	Audience string
+	// Leeway 校验exp/nbf/iat时允许的时钟偏差
+	Leeway time.Duration
+	// ChallengeExpire 两步验证的challenge有效期，默认5分钟
+	ChallengeExpire time.Duration
+	// TOTPIssuer otpauth URI中的issuer，显示在身份验证器app中
+	TOTPIssuer string
+	// Lockout 登录失败的退避及锁定，为nil时不限制
+	Lockout   *LockoutPolicy
+	lockoutMu sync.Mutex
+}
+
+// keySet 未设置Keys时，用Salt构建一个HS256的KeySet
+// 只构建一次，构建handler时即调用，之后cfg.Keys只读
+func (cfg *LogioConfig) keySet() *KeySet {
+	cfg.keysOnce.Do(func() {
+		if cfg.Keys == nil {
+			cfg.Keys = NewKeySet().Add(HMACKey("", []byte(cfg.Salt)))
+		}
+	})
+	return cfg.Keys
+}
+
+// revokeTTL 撤销记录至少要保存到所有已签发的token过期
+func (cfg *LogioConfig) revokeTTL() time.Duration {
+	if cfg == nil {
+		return defaultRevokeTTL
+	}
+	ttl := cfg.Expire
+	if cfg.RefreshExpire > ttl {
+		ttl = cfg.RefreshExpire
+	}
+	if ttl <= 0 {
+		return defaultRevokeTTL
+	}
+	return ttl
+}
+
+// LoginHandler 登录，成功后返回token(及refresh_token)
+func (cfg *LogioConfig) LoginHandler(tabler btypes.Tabler, jwt btypes.JwtSession, actions ...btypes.Action) btypes.ContextConfig {
+	cfg.keySet()
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamLogin, config: cfg}, jwt, actions...)
+}
+
+// LogoutHandler 登出，该用户之前签发的所有token都失效
+func (cfg *LogioConfig) LogoutHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamLogout, config: cfg}, nil, actions...)
+}
+
+// RefreshHandler 用refresh_token换取新的token及refresh_token，旧的refresh_token随即失效
+// payload: {"refresh_token": "..."}
+func (cfg *LogioConfig) RefreshHandler(jwt btypes.JwtSession, actions ...btypes.Action) btypes.ContextConfig {
+	if cfg.Mode == SessionOpaque {
+		panic("不透明session按空闲时间自动延长，不需要refresh")
+	}
+	cfg.keySet()
+	return btypes.HandlerFunc(&btypes.VirtualTable{},
+		&ParameterLogio{ParamLogio: ParamRefresh, config: cfg, jwt: jwt}, nil, actions...)
+}
+
+// issueTokens 为sess签发access token，如果配置了RefreshExpire，同时签发refresh token
+// 不透明session只签发token
+func (cfg *LogioConfig) issueTokens(c *btypes.Context, sess btypes.JwtSession) btypes.Pairs {
+	if cfg.Mode == SessionOpaque {
+		token, record := cfg.issueOpaque(c, sess)
+		if c.WsClient != nil {
+			bindOpaque(c.WsClient, token, record)
+		}
+		return btypes.Pairs{btypes.Pair{Key: "token", Value: token}}
+	}
+
+	gen := tokenGeneration(c.Cacher, sess.UserID())
+
+	token, err := cfg.signToken(sess, tokenAccess, gen, cfg.Expire)
+	if err != nil {
+		panic(err)
+	}
+	pairs := btypes.Pairs{btypes.Pair{Key: "token", Value: token}}
+
+	// websocket连接上登录或刷新，绑定新的session
+	if c.WsClient != nil {
+		bound := sess.New()
+		claims, err := cfg.parseToken(token, bound)
+		if err != nil {
+			panic(err)
+		}
+		bindClient(c.WsClient, bound, claims)
+	}
+
+	if cfg.RefreshExpire > 0 {
+		refresh, err := cfg.signToken(sess, tokenRefresh, gen, cfg.RefreshExpire)
+		if err != nil {
+			panic(err)
+		}
+		pairs.Add("refresh_token", refresh)
+	}
+	return pairs
+}
+
+// refresh 校验refresh token，撤销它并签发新的token
+func (cfg *LogioConfig) refresh(c *btypes.Context, refreshToken string, sess btypes.JwtSession) (btypes.Pairs, error) {
+	claims, err := cfg.parseToken(refreshToken, sess)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type != tokenRefresh {
+		return nil, btypes.ErrInvalidToken
+	}
+
+	jti := claims.Id
+	if isTokenRevoked(c.Cacher, sess.UserID(), claims.Gen, jti) {
+		// 已经用过的refresh token再次出现，可能被盗用，撤销该用户所有的token
+		if _, used := c.Cacher.Get(revokedTokenKey(jti)); used {
+			c.Logger.Warnf("refresh token %q 被重复使用，撤销用户 %d 所有的token", jti, sess.UserID())
+			RevokeUser(c.Cacher, sess.UserID(), cfg.revokeTTL())
+		}
+		return nil, btypes.ErrInvalidToken
+	}
+	// 轮换: 旧的refresh token只能使用一次
+	btypes.SetDurable(c.Cacher, revokedTokenKey(jti), true, time.Until(claims.expires()))
+
+	return cfg.issueTokens(c, sess), nil
+}
+
+// verifyAccessToken 校验access token并解析到sess，refresh token或已撤销的token都是无效的
+func (cfg *LogioConfig) verifyAccessToken(cacher btypes.Cacher, token string, sess btypes.JwtSession) (*tokenClaims, error) {
+	claims, err := cfg.parseToken(token, sess)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Type == tokenRefresh || isTokenRevoked(cacher, sess.UserID(), claims.Gen, claims.Id) {
+		return nil, btypes.ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func newTokenID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// ***************************** 撤销 *********************************
+// 每个用户有一个token代数(generation)，签发token时写入gen
+// 登出或修改密码时代数加1，gen小于当前代数的token全部失效
+// 单个token(比如用过的refresh token)按jti撤销
+// 代数及撤销记录被淘汰后已撤销的token又会有效，都用Increment或SetDurable保存
+
+func generationKey(userID uint) string  { return fmt.Sprintf("jwt/gen/%d", userID) }
+func revokedTokenKey(jti string) string { return "jwt/revoked/" + jti }
+
+func tokenGeneration(cacher btypes.Cacher, userID uint) int64 {
+	if cacher == nil {
+		return 0
+	}
+	if gen, ok := cacher.Get(generationKey(userID)); ok {
+		return gen.(int64)
+	}
+	return 0
+}
+
+// RevokeUser 使该用户之前签发的所有token失效
+// ttl: 撤销记录保存的时间，应不短于token的有效期
+// 代数原子地加1，同时撤销不会丢失
+func RevokeUser(cacher btypes.Cacher, userID uint, ttl time.Duration) {
+	btypes.Increment(cacher, generationKey(userID), ttl)
+}
+
+func isTokenRevoked(cacher btypes.Cacher, userID uint, gen int64, jti string) bool {
+	if cacher == nil {
+		return false
+	}
+	if gen < tokenGeneration(cacher, userID) {
+		return true
+	}
+	if jti == "" {
+		return false
+	}
+	_, revoked := cacher.Get(revokedTokenKey(jti))
+	return revoked
+}
@@ -0,0 +1,127 @@
+package middlewares_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/cache"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenFixture alice(1)及bob(2)可以登录，签发token及refresh_token
+type tokenFixture struct {
+	t         *testing.T
+	cfg       *middlewares.LogioConfig
+	cacher    *cache.Cache
+	call      func(config btypes.ContextConfig, typ, payload string) (btypes.Pairs, error)
+	authorize btypes.Action
+}
+
+func newTokenFixture(t *testing.T) *tokenFixture {
+	_, gdb := newUsersDB(t,
+		registerUser{Account: "alice", Password: "alice-pw"},
+		registerUser{Account: "bob", Password: "bob-pw"})
+	f := &tokenFixture{
+		t:      t,
+		cfg:    &middlewares.LogioConfig{Expire: time.Hour, RefreshExpire: 24 * time.Hour, Cost: bcrypt.MinCost},
+		cacher: cache.New(logger.MultiTargets{}),
+	}
+	f.authorize = f.cfg.Authorize(&loginSession{})
+	f.call = func(config btypes.ContextConfig, typ, payload string) (btypes.Pairs, error) {
+		c := &btypes.Context{
+			DB:      &btypes.DB{Gorm: gdb},
+			Cacher:  f.cacher,
+			Logger:  logger.MultiTargets{},
+			HttpReq: &http.Request{RemoteAddr: "10.0.0.1:5000"},
+			Request: &btypes.Request{Type: typ, Payload: []byte(payload)},
+		}
+		require.NoError(t, config(c))
+		result, err := c.Parameter.Call(c, c.Tabler)
+		return result.Payloads, err
+	}
+	return f
+}
+
+// login 返回token及refresh_token
+func (f *tokenFixture) login(account string) (string, string) {
+	pairs, err := f.call(f.cfg.LoginHandler(&registerUser{}, &loginSession{}), "users/login",
+		fmt.Sprintf(`{"account":%q,"password":"%s-pw"}`, account, account))
+	require.NoError(f.t, err)
+	return pairs[0].Value.(string), pairs[1].Value.(string)
+}
+
+func (f *tokenFixture) refresh(refreshToken string) (string, string, error) {
+	pairs, err := f.call(f.cfg.RefreshHandler(&loginSession{}), "users/refresh",
+		fmt.Sprintf(`{"refresh_token":%q}`, refreshToken))
+	if err != nil {
+		return "", "", err
+	}
+	return pairs[0].Value.(string), pairs[1].Value.(string), nil
+}
+
+func (f *tokenFixture) valid(token string) bool {
+	return authorizeHTTP(f.authorize, f.cacher, token) != nil
+}
+
+// evict 写满Cacher的容量，普通的值都被淘汰
+func (f *tokenFixture) evict() {
+	for i := 0; i < 4096; i++ {
+		f.cacher.Set(fmt.Sprintf("filler/%d", i), i)
+	}
+}
+
+func TestRefreshRotation(t *testing.T) {
+	f := newTokenFixture(t)
+	access, refresh := f.login("alice")
+	bob, _ := f.login("bob")
+
+	// 换取新的token，旧的refresh token随即失效，access token不受影响
+	access2, refresh2, err := f.refresh(refresh)
+	require.NoError(t, err)
+	assert.NotEqual(t, refresh, refresh2)
+	assert.True(t, f.valid(access))
+	assert.True(t, f.valid(access2))
+	// refresh token不能作为access token
+	assert.False(t, f.valid(refresh2))
+
+	// 用过的refresh token再次出现，视为被盗用，撤销该用户所有的token
+	f.evict()
+	_, _, err = f.refresh(refresh)
+	assert.True(t, errors.Is(err, btypes.ErrInvalidToken))
+	assert.False(t, f.valid(access))
+	assert.False(t, f.valid(access2))
+	_, _, err = f.refresh(refresh2)
+	assert.True(t, errors.Is(err, btypes.ErrInvalidToken))
+	assert.True(t, f.valid(bob))
+
+	// 重新登录后可以再使用
+	access, refresh = f.login("alice")
+	assert.True(t, f.valid(access))
+	_, _, err = f.refresh(refresh)
+	assert.NoError(t, err)
+}
+
+func TestRevokeUser(t *testing.T) {
+	f := newTokenFixture(t)
+	access, refresh := f.login("alice")
+	bob, _ := f.login("bob")
+
+	middlewares.RevokeUser(f.cacher, 1, time.Hour)
+	// 撤销记录不会因Cacher的容量被淘汰
+	f.evict()
+	assert.False(t, f.valid(access))
+	_, _, err := f.refresh(refresh)
+	assert.True(t, errors.Is(err, btypes.ErrInvalidToken))
+	assert.True(t, f.valid(bob))
+
+	access, _ = f.login("alice")
+	assert.True(t, f.valid(access))
+}
@@ -0,0 +1,199 @@
+package middlewares
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/eruca/bisel/btypes"
+)
+
+const topicKey = "Flow @Topic"
+
+var (
+	_ btypes.Parameter = (*TopicParameter)(nil)
+
+	errTopicNotWebsocket = errors.New("只有websocket连接可以订阅")
+	errTopicEmpty        = errors.New("topics不能为空")
+	errTopicUnknown      = errors.New("未知的topic")
+)
+
+// Topics 可以订阅的topic: 表名、table/id及注册过的自定义topic
+// 订阅需要btypes.TopicRouter(topic)的权限，table/id使用该表的权限
+// 在启动前注册，之后只读
+type Topics struct {
+	tables map[string]btypes.Tabler
+	custom map[string]struct{}
+}
+
+// NewTopics 这些表的表名及table/id可以订阅
+func NewTopics(tablers ...btypes.Tabler) *Topics {
+	topics := &Topics{
+		tables: make(map[string]btypes.Tabler, len(tablers)),
+		custom: make(map[string]struct{}),
+	}
+	for _, tabler := range tablers {
+		topics.tables[tabler.TableName()] = tabler
+	}
+	return topics
+}
+
+// Add 注册自定义topic，不能与表名相同
+func (t *Topics) Add(names ...string) {
+	for _, name := range names {
+		if _, ok := t.tables[name]; ok {
+			panic(fmt.Sprintf("自定义topic %q 与表名相同", name))
+		}
+		t.custom[name] = struct{}{}
+	}
+}
+
+// CanReadTable sess能否订阅该表的topic
+// 实现了RowScoper的表不能整表订阅，否则会收到范围外的数据，只能订阅table/id
+func (t *Topics) CanReadTable(ac *btypes.AccessControl, sess btypes.JwtSession, tableName string) error {
+	tabler, ok := t.tables[tableName]
+	if !ok {
+		return fmt.Errorf("%w: %s", errTopicUnknown, tableName)
+	}
+	if err := authorizeTopic(ac, sess, tableName); err != nil {
+		return err
+	}
+	if _, scoped := tabler.(btypes.RowScoper); scoped {
+		return fmt.Errorf("%w: %s 有行级范围，只能订阅 %s/id", btypes.ErrForbidden, tableName, tableName)
+	}
+	return nil
+}
+
+// check 订阅前检查topic是否存在、权限及行级范围
+func (t *Topics) check(c *btypes.Context, topic string) error {
+	if _, ok := t.custom[topic]; ok {
+		return authorizeTopic(c.AccessControl, c.JwtSess, topic)
+	}
+	if _, ok := t.tables[topic]; ok {
+		return t.CanReadTable(c.AccessControl, c.JwtSess, topic)
+	}
+
+	i := strings.LastIndexByte(topic, '/')
+	if i < 0 {
+		return fmt.Errorf("%w: %s", errTopicUnknown, topic)
+	}
+	tabler, ok := t.tables[topic[:i]]
+	id, err := strconv.ParseUint(topic[i+1:], 10, 64)
+	if !ok || err != nil || id == 0 {
+		return fmt.Errorf("%w: %s", errTopicUnknown, topic)
+	}
+	if err := authorizeTopic(c.AccessControl, c.JwtSess, topic[:i]); err != nil {
+		return err
+	}
+
+	// 范围外的行与不存在一样
+	scope := btypes.RowScopeOf(tabler, c.JwtSess)
+	if scope == nil {
+		return nil
+	}
+	var count int64
+	if err := c.DB.Gorm.Model(tabler.New()).Where("id = ?", id).Where(scope.Query, scope.Args...).Count(&count).Error; err != nil {
+		c.Logger.Errorf("订阅 %s 时检查行级范围发生错误: %s", topic, err.Error())
+		return btypes.ErrRecordNotFound
+	}
+	if count == 0 {
+		return btypes.ErrRecordNotFound
+	}
+	return nil
+}
+
+func authorizeTopic(ac *btypes.AccessControl, sess btypes.JwtSession, topic string) error {
+	if ac == nil {
+		return nil
+	}
+	return ac.Authorize(sess, btypes.TopicRouter(topic))
+}
+
+type topicPayload struct {
+	Topics []string `json:"topics"`
+}
+
+// fromRawMessage 去掉空的topic
+func (p *topicPayload) fromRawMessage(rm json.RawMessage) error {
+	if len(rm) == 0 {
+		return errTopicEmpty
+	}
+	if err := json.Unmarshal(rm, p); err != nil {
+		return err
+	}
+	topics := p.Topics[:0]
+	for _, topic := range p.Topics {
+		if topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	if p.Topics = topics; len(topics) == 0 {
+		return errTopicEmpty
+	}
+	return nil
+}
+
+// TopicParameter 订阅或取消订阅websocket广播，需要认证
+// payload: {"topics": ["orders", "orders/3", "自定义"]}
+// 表名订阅该表所有的写入，table/id只订阅该行
+// 在请求间共用，topics在Call中解析
+type TopicParameter struct {
+	topics    *Topics
+	subscribe bool
+}
+
+func (tp *TopicParameter) String() string {
+	if tp.subscribe {
+		return topicKey + " Subscribe"
+	}
+	return topicKey + " Unsubscribe"
+}
+
+// FromRawMessage 只检查payload的格式
+func (tp *TopicParameter) FromRawMessage(_ btypes.Tabler, rm json.RawMessage) error {
+	return new(topicPayload).fromRawMessage(rm)
+}
+func (*TopicParameter) Status() btypes.RequestStatus { return btypes.StatusNoop }
+func (*TopicParameter) ReadForceUpdate() bool        { return false }
+func (*TopicParameter) BuildCacheKey(string) string  { return "" }
+func (*TopicParameter) JwtCheck() bool               { return true }
+
+func (tp *TopicParameter) Call(c *btypes.Context, _ btypes.Tabler) (result btypes.Result, err error) {
+	if c.WsClient == nil {
+		err = errTopicNotWebsocket
+		return
+	}
+	var payload topicPayload
+	if err = payload.fromRawMessage(c.Request.Payload); err != nil {
+		return
+	}
+
+	if tp.subscribe {
+		// 任一topic不能订阅时都不订阅
+		for _, topic := range payload.Topics {
+			if err = tp.topics.check(c, topic); err != nil {
+				return
+			}
+		}
+		c.WsClient.Subscribe(payload.Topics...)
+	} else {
+		c.WsClient.Unsubscribe(payload.Topics...)
+	}
+	result.Payloads.Add("topics", payload.Topics)
+	return
+}
+
+// SubscribeHandler 订阅topics，actions中需要有认证的Action(比如JWTAuthorize)
+func SubscribeHandler(topics *Topics, actions ...btypes.Action) btypes.ContextConfig {
+	if topics == nil {
+		panic("topics不能为nil")
+	}
+	return btypes.HandlerFunc(&btypes.VirtualTable{}, &TopicParameter{topics: topics, subscribe: true}, nil, actions...)
+}
+
+// UnsubscribeHandler 取消订阅topics
+func UnsubscribeHandler(actions ...btypes.Action) btypes.ContextConfig {
+	return btypes.HandlerFunc(&btypes.VirtualTable{}, &TopicParameter{}, nil, actions...)
+}
@@ -0,0 +1,77 @@
+package middlewares_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/eruca/bisel/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// scopedNote 只能看到自己的笔记
+type scopedNote struct {
+	btypes.VirtualTable
+	OwnerID uint
+}
+
+func (*scopedNote) New() btypes.Tabler   { return &scopedNote{} }
+func (*scopedNote) TableName() string    { return "notes" }
+func (*scopedNote) Depends() []string    { return nil }
+func (*scopedNote) QueryOmits() []string { return nil }
+func (*scopedNote) RowScope(sess btypes.JwtSession) btypes.RowScope {
+	return btypes.RowScope{Query: "owner_id = ?", Args: []interface{}{sess.UserID()}}
+}
+
+func TestSubscribeChecks(t *testing.T) {
+	gdb, err := gorm.Open(nil, &gorm.Config{DryRun: true})
+	require.NoError(t, err)
+
+	topics := middlewares.NewTopics(&registerUser{}, &scopedNote{})
+	topics.Add("news")
+	access := btypes.NewAccessControl().Require(btypes.TopicRouter("users"), "users/read")
+	subscribe := middlewares.SubscribeHandler(topics)
+
+	call := func(payload string) error {
+		c := &btypes.Context{
+			DB:            &btypes.DB{Gorm: gdb},
+			Logger:        logger.MultiTargets{},
+			AccessControl: access,
+			JwtSess:       &claimsSession{ID: 1},
+			WsClient:      &ws.Client{},
+			Request:       &btypes.Request{Type: "topic/subscribe", Payload: []byte(payload)},
+		}
+		require.NoError(t, subscribe(c))
+		assert.True(t, c.Parameter.JwtCheck())
+		_, err := c.Parameter.Call(c, c.Tabler)
+		return err
+	}
+
+	// 不存在的表或行
+	assert.Error(t, call(`{"topics": ["orders"]}`))
+	assert.Error(t, call(`{"topics": ["orders/1"]}`))
+	assert.Error(t, call(`{"topics": ["news/1"]}`))
+	assert.Error(t, call(`{"topics": ["users/x"]}`))
+	// 没有该表的读权限，table/id也一样
+	assert.True(t, errors.Is(call(`{"topics": ["users"]}`), btypes.ErrForbidden))
+	assert.True(t, errors.Is(call(`{"topics": ["users/3"]}`), btypes.ErrForbidden))
+	// 有行级范围的表不能整表订阅，范围外的行与不存在一样
+	assert.True(t, errors.Is(call(`{"topics": ["notes"]}`), btypes.ErrForbidden))
+	assert.True(t, errors.Is(call(`{"topics": ["notes/3"]}`), btypes.ErrRecordNotFound))
+
+	// 有权限时可以整表订阅
+	reader := &readerSession{claimsSession: claimsSession{ID: 1}, perms: []string{"users/read"}}
+	assert.NoError(t, topics.CanReadTable(access, reader, "users"))
+	assert.Error(t, topics.CanReadTable(access, nil, "users"))
+}
+
+type readerSession struct {
+	claimsSession
+	perms []string
+}
+
+func (s *readerSession) Permissions() []string { return s.perms }
@@ -0,0 +1,412 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ***************************** RFC 6238 *********************************
+// HMAC-SHA1，30秒一个周期，6位数字，验证时前后各允许一个周期的偏差
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1
+
+	// 挑战token的有效期及可尝试的次数
+	defaultChallengeExpire = 5 * time.Minute
+	maxChallengeAttempts   = 5
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret 160位随机secret，base32编码
+func GenerateTOTPSecret() string {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(buf)
+}
+
+// TOTPCode 计算secret在t时刻的验证码
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// ValidateTOTP 验证code，成功时返回匹配的周期，用于防止同一个code被重复使用
+func ValidateTOTP(secret, code string, t time.Time) (counter int64, ok bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(current+int64(i)))), []byte(code)) == 1 {
+			return current + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// TOTPURI 身份验证器app扫描的otpauth URI
+func TOTPURI(issuer, account, secret string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	if issuer != "" {
+		query.Set("issuer", issuer)
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	return totpEncoding.DecodeString(strings.TrimRight(strings.ToUpper(strings.ReplaceAll(secret, " ", "")), "="))
+}
+
+// hotp RFC 4226
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// ***************************** 两步验证登录 *********************************
+
+// TOTPLoginer 实现该接口的Loginer可以开启两步验证
+type TOTPLoginer interface {
+	Loginer
+	// GetTOTPSecret Key是列名，Value是base32的secret，为空表示未开启
+	GetTOTPSecret() btypes.PairStringer
+	// GetRecoveryCodes Key是列名，Value是以","连接的bcrypt后的恢复码
+	GetRecoveryCodes() btypes.PairStringer
+}
+
+// totpPayload login/verify及开启两步验证时的payload
+type totpPayload struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// enrollPayload 生成新的secret前再次验证身份: 已开启两步验证时需要当前的验证码，否则需要密码
+type enrollPayload struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+func (p *enrollPayload) fromRawMessage(rm json.RawMessage) error {
+	if len(rm) > 0 {
+		if err := json.Unmarshal(rm, p); err != nil {
+			return err
+		}
+	}
+	if p.Password == "" && p.Code == "" {
+		return errors.New("需要password或code")
+	}
+	return nil
+}
+
+// loginChallenge 密码正确后等待两步验证的登录，失败次数记在challengeAttemptsKey
+type loginChallenge struct {
+	userID uint
+	sess   btypes.JwtSession
+}
+
+// pendingTOTP 等待确认的secret及明文恢复码
+type pendingTOTP struct {
+	secret        string
+	recoveryCodes []string
+}
+
+func challengeKey(token string) string         { return "login/challenge/" + token }
+func challengeAttemptsKey(token string) string { return challengeKey(token) + "/attempts" }
+func pendingTOTPKey(userID uint) string        { return fmt.Sprintf("totp/pending/%d", userID) }
+func usedTOTPKey(userID uint, c int64) string  { return fmt.Sprintf("totp/used/%d/%d", userID, c) }
+
+// VerifyHandler login/verify，用登录返回的challenge及验证码(或恢复码)完成登录
+// payload: {"challenge": "...", "code": "123456"} 或 {"challenge": "...", "recovery_code": "..."}
+func (cfg *LogioConfig) VerifyHandler(tabler btypes.Tabler, jwt btypes.JwtSession, actions ...btypes.Action) btypes.ContextConfig {
+	mustTOTPLoginer(tabler)
+	cfg.keySet()
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamVerify, config: cfg}, jwt, actions...)
+}
+
+// TOTPEnrollHandler 为当前用户生成secret、otpauth URI及恢复码，需要TOTPConfirmHandler确认后才开启
+// payload: {"password": "..."}，已开启两步验证时 {"code": "123456"}
+func (cfg *LogioConfig) TOTPEnrollHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
+	mustTOTPLoginer(tabler)
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamTOTPEnroll, config: cfg}, nil, actions...)
+}
+
+// TOTPConfirmHandler 用app上的验证码确认后开启两步验证
+// payload: {"code": "123456"}
+func (cfg *LogioConfig) TOTPConfirmHandler(tabler btypes.Tabler, actions ...btypes.Action) btypes.ContextConfig {
+	mustTOTPLoginer(tabler)
+	return btypes.HandlerFunc(tabler, &ParameterLogio{ParamLogio: ParamTOTPConfirm, config: cfg}, nil, actions...)
+}
+
+func mustTOTPLoginer(tabler btypes.Tabler) {
+	if _, ok := tabler.(TOTPLoginer); !ok {
+		panic("tabler 必须实现 TOTPLoginer 接口")
+	}
+}
+
+func (cfg *LogioConfig) challengeExpire() time.Duration {
+	if cfg.ChallengeExpire <= 0 {
+		return defaultChallengeExpire
+	}
+	return cfg.ChallengeExpire
+}
+
+// totpEnabled 该用户开启了两步验证
+func totpEnabled(user btypes.Tabler) bool {
+	totp, ok := user.(TOTPLoginer)
+	return ok && totp.GetTOTPSecret().Value.String() != ""
+}
+
+// challenge 密码正确且开启了两步验证，返回challenge代替token
+func (cfg *LogioConfig) challenge(c *btypes.Context, user btypes.Tabler) btypes.Pairs {
+	mustCacher(c.Cacher)
+
+	token := newTokenID()
+	btypes.SetWithExpire(c.Cacher, challengeKey(token),
+		&loginChallenge{userID: user.Model().ID, sess: copySession(c.JwtSess)}, cfg.challengeExpire())
+
+	var pairs btypes.Pairs
+	pairs.Add("totp_required", true)
+	pairs.Add("challenge", token)
+	return pairs
+}
+
+// verify 校验challenge及验证码，成功后与登录一样返回token
+func (cfg *LogioConfig) verify(c *btypes.Context, tabler btypes.Tabler, payload *totpPayload) (btypes.Tabler, error) {
+	mustCacher(c.Cacher)
+
+	key := challengeKey(payload.Challenge)
+	v, ok := c.Cacher.Get(key)
+	if !ok {
+		return nil, btypes.ErrInvalidToken
+	}
+	ch := v.(*loginChallenge)
+
+	user := tabler.New()
+	if err := c.DB.Gorm.Model(user).Where("id = ?", ch.userID).First(user).Error; err != nil {
+		c.Cacher.Remove(key)
+		return nil, btypes.ErrInvalidToken
+	}
+
+	// 验证码的失败与密码一样计入该账号及地址的退避及锁定
+	account := user.(Loginer).GetAccount().Value.String()
+	attempt, err := cfg.beginAttempt(c, account, remoteAddr(c.HttpReq))
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.checkSecondFactor(c, user, payload) {
+		attempt.settle(c, btypes.ErrInvalidTOTP)
+		// challenge在Cacher中共用，失败次数原子地累加
+		if n := btypes.Increment(c.Cacher, challengeAttemptsKey(payload.Challenge), cfg.challengeExpire()); n >= maxChallengeAttempts {
+			c.Cacher.Remove(key)
+			c.Cacher.Remove(challengeAttemptsKey(payload.Challenge))
+			c.Logger.Warnf("[audit] 用户 %d 两步验证失败%d次，challenge作废", ch.userID, n)
+		}
+		return nil, btypes.ErrInvalidTOTP
+	}
+
+	attempt.settle(c, nil)
+	cfg.clearFailures(c, account)
+	c.Cacher.Remove(key)
+	c.Cacher.Remove(challengeAttemptsKey(payload.Challenge))
+	c.JwtSess = ch.sess
+	return user, nil
+}
+
+// checkSecondFactor 验证码或恢复码，恢复码只能使用一次
+func (cfg *LogioConfig) checkSecondFactor(c *btypes.Context, user btypes.Tabler, payload *totpPayload) bool {
+	userID := user.Model().ID
+	totp := user.(TOTPLoginer)
+
+	if payload.RecoveryCode != "" {
+		codes := totp.GetRecoveryCodes()
+		hashes := splitRecoveryCodes(codes.Value.String())
+		for i, hashed := range hashes {
+			if bcrypt.CompareHashAndPassword([]byte(hashed), []byte(normalizeRecoveryCode(payload.RecoveryCode))) == nil {
+				remain := append(hashes[:i:i], hashes[i+1:]...)
+				updateColumns(c, user, map[string]interface{}{codes.Key: strings.Join(remain, ",")})
+				c.Logger.Warnf("[audit] 用户 %d 使用了恢复码登录，剩余%d个", userID, len(remain))
+				return true
+			}
+		}
+		return false
+	}
+
+	counter, ok := ValidateTOTP(totp.GetTOTPSecret().Value.String(), payload.Code, time.Now())
+	if !ok {
+		return false
+	}
+	// 同一个验证码不能重复使用
+	used := usedTOTPKey(userID, counter)
+	if _, replay := c.Cacher.Get(used); replay {
+		return false
+	}
+	btypes.SetDurable(c.Cacher, used, true, (2*totpSkew+1)*totpPeriod*time.Second)
+	return true
+}
+
+// enroll 再次验证身份后生成待确认的secret及恢复码
+// 验证失败与登录一样计入该账号的退避及锁定，被盗用的token不能借此猜测密码
+func (cfg *LogioConfig) enroll(c *btypes.Context, tabler btypes.Tabler, payload *enrollPayload) (btypes.Pairs, error) {
+	mustCacher(c.Cacher)
+
+	userID := c.JwtSess.UserID()
+	user := tabler.New()
+	if err := c.DB.Gorm.Model(user).Where("id = ?", userID).First(user).Error; err != nil {
+		return nil, btypes.ErrRecordNotFound
+	}
+
+	account := user.(Loginer).GetAccount().Value.String()
+	attempt, err := cfg.beginAttempt(c, account, remoteAddr(c.HttpReq))
+	if err != nil {
+		return nil, err
+	}
+	if err = cfg.reauthenticate(c, user, payload); err != nil {
+		attempt.settle(c, err)
+		c.Logger.Warnf("[audit] 用户 %d 生成两步验证secret时身份验证失败", userID)
+		return nil, err
+	}
+	attempt.settle(c, nil)
+
+	pending := &pendingTOTP{secret: GenerateTOTPSecret(), recoveryCodes: make([]string, recoveryCodeCount)}
+	for i := range pending.recoveryCodes {
+		pending.recoveryCodes[i] = newRecoveryCode()
+	}
+	btypes.SetWithExpire(c.Cacher, pendingTOTPKey(userID), pending, cfg.challengeExpire())
+
+	var pairs btypes.Pairs
+	pairs.Add("secret", pending.secret)
+	pairs.Add("uri", TOTPURI(cfg.TOTPIssuer, account, pending.secret))
+	pairs.Add("recovery_codes", pending.recoveryCodes)
+	return pairs, nil
+}
+
+// reauthenticate 已开启两步验证时用当前的验证码，否则用密码
+func (cfg *LogioConfig) reauthenticate(c *btypes.Context, user btypes.Tabler, payload *enrollPayload) error {
+	if totpEnabled(user) {
+		if payload.Code == "" || !cfg.checkSecondFactor(c, user, &totpPayload{Code: payload.Code}) {
+			return btypes.ErrInvalidTOTP
+		}
+		return nil
+	}
+
+	hashed := user.(Loginer).GetPassword().Value.String()
+	if payload.Password == "" || bcrypt.CompareHashAndPassword([]byte(hashed), []byte(payload.Password)) != nil {
+		return btypes.ErrAccountNotExistOrPasswordNotCorrect
+	}
+	return nil
+}
+
+// confirm 验证码正确后保存secret及bcrypt后的恢复码
+func (cfg *LogioConfig) confirm(c *btypes.Context, tabler btypes.Tabler, payload *totpPayload) (btypes.Pairs, error) {
+	mustCacher(c.Cacher)
+
+	userID := c.JwtSess.UserID()
+	v, ok := c.Cacher.Get(pendingTOTPKey(userID))
+	if !ok {
+		return nil, btypes.ErrInvalidTOTP
+	}
+	pending := v.(*pendingTOTP)
+	if _, ok := ValidateTOTP(pending.secret, payload.Code, time.Now()); !ok {
+		return nil, btypes.ErrInvalidTOTP
+	}
+
+	hashes := make([]string, len(pending.recoveryCodes))
+	for i, code := range pending.recoveryCodes {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(code), cfg.bcryptCost())
+		if err != nil {
+			panic(err)
+		}
+		hashes[i] = string(hashed)
+	}
+
+	user := tabler.New()
+	user.Model().ID = userID
+	totp := user.(TOTPLoginer)
+	updateColumns(c, user, map[string]interface{}{
+		totp.GetTOTPSecret().Key:    pending.secret,
+		totp.GetRecoveryCodes().Key: strings.Join(hashes, ","),
+	})
+	c.Cacher.Remove(pendingTOTPKey(userID))
+	c.Logger.Warnf("[audit] 用户 %d 开启了两步验证", userID)
+
+	var pairs btypes.Pairs
+	pairs.Add("msg", "两步验证已开启")
+	return pairs, nil
+}
+
+func (p *totpPayload) fromRawMessage(rm json.RawMessage) error {
+	if err := json.Unmarshal(rm, p); err != nil {
+		return err
+	}
+	if p.Code == "" && p.RecoveryCode == "" {
+		return errors.New("需要code或recovery_code")
+	}
+	return nil
+}
+
+// newRecoveryCode 50位随机数，形如 abcde-fgh23
+func newRecoveryCode() string {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(buf))
+	return code[:5] + "-" + code[5:10]
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+func splitRecoveryCodes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func updateColumns(c *btypes.Context, user btypes.Tabler, columns map[string]interface{}) {
+	if err := c.DB.Gorm.Model(user.New()).Where("id = ?", user.Model().ID).Updates(columns).Error; err != nil {
+		panic(err)
+	}
+}
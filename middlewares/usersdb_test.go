@@ -0,0 +1,132 @@
+package middlewares_test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	gormlogger "gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// usersDB 内存中的users表，只理解按account或id查询一行，及按id修改password
+type usersDB struct {
+	mu   sync.Mutex
+	rows []registerUser
+}
+
+// newUsersDB users表中的用户，密码以bcrypt.MinCost hash
+func newUsersDB(t require.TestingT, users ...registerUser) (*usersDB, *gorm.DB) {
+	db := &usersDB{}
+	for i, user := range users {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+		require.NoError(t, err)
+		user.ID, user.Version, user.Password = uint(i+1), 1, string(hashed)
+		db.rows = append(db.rows, user)
+	}
+	gdb, err := gorm.Open(usersDialector{db: db}, &gorm.Config{Logger: gormlogger.Discard})
+	require.NoError(t, err)
+	return db, gdb
+}
+
+func (db *usersDB) password(id uint) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.rows[id-1].Password
+}
+
+func (db *usersDB) Connect(context.Context) (driver.Conn, error) { return usersConn{db: db}, nil }
+func (db *usersDB) Driver() driver.Driver                        { return nil }
+
+type usersConn struct{ db *usersDB }
+
+func (usersConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (usersConn) Close() error                        { return nil }
+func (usersConn) Begin() (driver.Tx, error)           { return usersTx{}, nil }
+
+type usersTx struct{}
+
+func (usersTx) Commit() error   { return nil }
+func (usersTx) Rollback() error { return nil }
+
+// QueryContext SELECT * FROM `users` WHERE account = ? ... 或 WHERE id = ? ...
+func (c usersConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	for _, row := range c.db.rows {
+		if strings.Contains(query, "account = ?") && args[0].Value == row.Account ||
+			strings.Contains(query, "id = ?") && args[0].Value == int64(row.ID) {
+			now := time.Now()
+			return &usersRows{values: [][]driver.Value{{
+				int64(row.ID), now, now, nil, int64(row.Version), row.Account, row.Password, row.Nickname, row.Role,
+			}}}, nil
+		}
+	}
+	return &usersRows{}, nil
+}
+
+// ExecContext UPDATE `users` SET `password`=?,`updated_at`=? WHERE id = ? ...
+func (c usersConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.HasPrefix(query, "UPDATE `users` SET `password`=?") {
+		return nil, errors.New("not supported: " + query)
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	for i := range c.db.rows {
+		if args[2].Value == int64(c.db.rows[i].ID) {
+			c.db.rows[i].Password = args[0].Value.(string)
+			return driver.RowsAffected(1), nil
+		}
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type usersRows struct {
+	values [][]driver.Value
+}
+
+func (*usersRows) Columns() []string {
+	return []string{"id", "created_at", "updated_at", "deleted_at", "version", "account", "password", "nickname", "role"}
+}
+func (*usersRows) Close() error { return nil }
+func (r *usersRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type usersDialector struct{ db *usersDB }
+
+func (usersDialector) Name() string { return "users" }
+func (d usersDialector) Initialize(db *gorm.DB) error {
+	callbacks.RegisterDefaultCallbacks(db, &callbacks.Config{})
+	db.ConnPool = sql.OpenDB(d.db)
+	return nil
+}
+func (usersDialector) Migrator(*gorm.DB) gorm.Migrator { return nil }
+func (usersDialector) DataTypeOf(*schema.Field) string { return "" }
+func (usersDialector) DefaultValueOf(*schema.Field) clause.Expression {
+	return clause.Expr{SQL: "DEFAULT"}
+}
+func (usersDialector) BindVarTo(w clause.Writer, _ *gorm.Statement, _ interface{}) { w.WriteByte('?') }
+func (usersDialector) QuoteTo(w clause.Writer, str string) {
+	w.WriteByte('`')
+	w.WriteString(str)
+	w.WriteByte('`')
+}
+func (usersDialector) Explain(sql string, vars ...interface{}) string {
+	return gormlogger.ExplainSQL(sql, nil, `'`, vars...)
+}
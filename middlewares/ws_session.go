@@ -0,0 +1,99 @@
+package middlewares
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/ws"
+)
+
+const wsTokenKey = "token"
+
+// wsSession 绑定在ws.Client上的session，保留gen及jti用于检查是否被撤销
+type wsSession struct {
+	btypes.JwtSession
+	gen int64
+	// 不透明session时是token
+	jti    string
+	opaque bool
+}
+
+// WebsocketAuthenticator 在websocket握手时认证
+// 依次从query参数token、Authorization头中读取access token，没有或无效时拒绝升级(401)
+// 需要允许匿名连接时不使用它，由Authorize在第一个带token的消息中绑定session
+// 不读取cookie: 握手不检查Origin，浏览器会为任何页面发起的连接带上cookie(跨站websocket劫持)
+// cacher 用于检查token是否已被撤销
+func (cfg *LogioConfig) WebsocketAuthenticator(jwt btypes.JwtSession, cacher btypes.Cacher) ws.Authenticate {
+	cfg.keySet()
+
+	return func(r *http.Request) (interface{}, uint, time.Time, error) {
+		token := tokenFromHttpRequest(r)
+		if token == "" {
+			return nil, 0, time.Time{}, btypes.ErrInvalidToken
+		}
+
+		// 没有cacher时不会签发不透明token，按jwt解析(无效)
+		if isOpaqueToken(token) && cacher != nil {
+			record, err := loadOpaque(cacher, token)
+			if err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			bound := &wsSession{JwtSession: record.sess, gen: record.gen, jti: token, opaque: true}
+			return bound, record.sess.UserID(), time.Now().Add(record.idle), nil
+		}
+
+		sess := jwt.New()
+		claims, err := cfg.verifyAccessToken(cacher, token, sess)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		return newWsSession(sess, claims), sess.UserID(), claims.expires(), nil
+	}
+}
+
+func tokenFromHttpRequest(r *http.Request) string {
+	if token := r.URL.Query().Get(wsTokenKey); token != "" {
+		return token
+	}
+	if v := r.Header.Get("Authorization"); len(v) > 7 && strings.ToLower(v[:6]) == "bearer" {
+		return v[7:]
+	}
+	return ""
+}
+
+func newWsSession(sess btypes.JwtSession, claims *tokenClaims) *wsSession {
+	return &wsSession{JwtSession: sess, gen: claims.Gen, jti: claims.Id}
+}
+
+// bindClient 将sess绑定到client，token过期时关闭连接
+func bindClient(client *ws.Client, sess btypes.JwtSession, claims *tokenClaims) {
+	client.Bind(newWsSession(sess, claims), sess.UserID(), claims.expires())
+}
+
+// useBoundSession 使用连接上绑定的session，登出或修改密码后该session失效
+// 不透明session每次使用都重新加载，并原地延长连接的有效期
+func (cfg *LogioConfig) useBoundSession(c *btypes.Context, bound *wsSession) btypes.PairStringer {
+	if bound.opaque {
+		record, err := loadOpaque(c.Cacher, bound.jti)
+		if err != nil {
+			c.WsClient.Unbind()
+			c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, err)
+			return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(err.Error())}
+		}
+		c.WsClient.Extend(time.Now().Add(record.idle))
+		c.JwtSess = record.sess
+		c.Next()
+		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("websocket bound opaque session")}
+	}
+	if isTokenRevoked(c.Cacher, bound.UserID(), bound.gen, bound.jti) {
+		c.WsClient.Unbind()
+		c.Responder = btypes.BuildErrorResposeFromRequest(c.ConfigResponseType, c.Request, btypes.ErrInvalidToken)
+		return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString(btypes.ErrInvalidToken.Error())}
+	}
+
+	c.JwtSess = bound.JwtSession
+	c.Next()
+	return btypes.PairStringer{Key: jwtKey, Value: btypes.ValueString("websocket bound session")}
+}
@@ -0,0 +1,96 @@
+package middlewares_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/eruca/bisel/btypes"
+	"github.com/eruca/bisel/logger"
+	"github.com/eruca/bisel/middlewares"
+	"github.com/eruca/bisel/ws"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketHandshake(t *testing.T) {
+	keys := middlewares.NewKeySet().Add(middlewares.HMACKey("", []byte("secret")))
+	cfg := &middlewares.LogioConfig{Keys: keys}
+	authorize := cfg.Authorize(&claimsSession{})
+	sign := func(id uint, expire time.Duration) string {
+		now := time.Now()
+		token, err := keys.Sign(jwt.MapClaims{"id": id, "jti": "j", "iat": now.Unix(), "exp": now.Add(expire).Unix()})
+		require.NoError(t, err)
+		return token
+	}
+
+	// 每个消息都是一个token(可以为空)，用Authorize处理后返回该连接绑定的用户
+	userids := make(chan uint, 1)
+	process := func(*http.Request) (ws.Process, ws.Disconnected) {
+		return func(client *ws.Client, _ chan ws.BroadcastRequest, msg []byte) {
+			c := &btypes.Context{
+				ConnectionType:     btypes.WEBSOCKET,
+				ConfigResponseType: func(typ string, ok bool) string { return typ },
+				Parameter:          &btypes.QueryParameter{CheckJWT: true},
+				WsClient:           client,
+				Request:            &btypes.Request{Type: "orders/query", Token: string(msg)},
+			}
+			c.AddActions(authorize, func(*btypes.Context) btypes.PairStringer { return btypes.PairStringer{} })
+			c.StartWorkFlow()
+			userids <- client.UserID()
+		}, func(*ws.Client) {}
+	}
+	server := httptest.NewServer(ws.WebsocketHandler(ws.NewHub(), process, nil,
+		cfg.WebsocketAuthenticator(&claimsSession{}, nil), logger.MultiTargets{}))
+	defer server.Close()
+
+	dial := func(token string) (*websocket.Conn, *http.Response, error) {
+		url := "ws" + strings.TrimPrefix(server.URL, "http")
+		if token != "" {
+			url += "?token=" + token
+		}
+		return websocket.DefaultDialer.Dial(url, nil)
+	}
+
+	// 没有或无效的token在升级之前以401拒绝
+	for _, token := range []string{"", "invalid", sign(7, -time.Minute)} {
+		_, resp, err := dial(token)
+		require.Error(t, err)
+		require.NotNil(t, resp)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	// 没有cacher时像不透明token的字符串也只是无效的token
+	assert.Nil(t, authorizeHTTP(authorize, nil, "invalid"))
+
+	// 握手时认证的用户绑定在ws.Client上，之后的消息不需要token
+	expiring, _, err := dial(sign(7, 2*time.Second))
+	require.NoError(t, err)
+	defer expiring.Close()
+	require.NoError(t, expiring.WriteMessage(websocket.TextMessage, nil))
+	assert.Equal(t, uint(7), <-userids)
+
+	// 在连接上用新的token刷新
+	refreshed, _, err := dial(sign(8, 2*time.Second))
+	require.NoError(t, err)
+	defer refreshed.Close()
+	require.NoError(t, refreshed.WriteMessage(websocket.TextMessage, []byte(sign(8, time.Hour))))
+	assert.Equal(t, uint(8), <-userids)
+
+	// token过期时关闭连接
+	expiring.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = expiring.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, ws.CloseTokenExpired), "%v", err)
+
+	// 刷新过的连接仍然可以使用
+	require.NoError(t, refreshed.WriteMessage(websocket.TextMessage, nil))
+	select {
+	case userid := <-userids:
+		assert.Equal(t, uint(8), userid)
+	case <-time.After(time.Second):
+		t.Fatal("刷新过的连接被关闭")
+	}
+}
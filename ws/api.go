@@ -3,21 +3,31 @@ package ws
 import (
 	"net/http"
 	"os"
-	"runtime"
+	"sync/atomic"
+	"time"
 
 	"github.com/eruca/bisel/logger"
 )
 
 // ProcessMixHttpRequest 混入*http.Request
-type ProcessMixHttpRequest func(req *http.Request) (Process, ClearUserID)
+type ProcessMixHttpRequest func(req *http.Request) (Process, Disconnected)
 
 // Process 是外部函数需要接收websocket的广播、发送、消息, req 代表连接的状态
 type Process func(client *Client, broadcast chan BroadcastRequest, msg []byte)
 
-type ClearUserID func(uint)
+// Disconnected 连接断开时调用，比如释放该连接持有的锁
+type Disconnected func(*Client)
 
-// Connected 代表如果连接一旦建立，就通过send向客户端发送数据
-type Connected func(send chan<- []byte)
+// Connected 代表如果连接一旦建立，就通过client.Push向客户端发送数据
+type Connected func(client *Client)
+
+// clientSeq 用于产生Client.ID
+var clientSeq uint64
+
+// Authenticate 在websocket握手时认证
+// 没有带token时返回的session为nil，连接仍然建立，之后可以在第一个消息中带token认证
+// token无效时返回error，拒绝升级
+type Authenticate func(r *http.Request) (session interface{}, userid uint, expire time.Time, err error)
 
 // WebsocketHandler 使用方法 获取hub.broadcast
 // eg: handler := WebsocketHandler(fn)
@@ -31,8 +41,11 @@ type Connected func(send chan<- []byte)
 // 比如连接成功后，客户端发送一个init状态，然后response需要初始化的数据
 // WriteClient 直接往broadcast里发送东西，那么会从ReadProcess里读出结果
 // 主要是作为websocket发起者时
-func WebsocketHandler(process ProcessMixHttpRequest, connected Connected, logger logger.Logger) http.HandlerFunc {
-	var hub = newHub()
+// hub为nil时新建一个
+func WebsocketHandler(hub *Hub, process ProcessMixHttpRequest, connected Connected, auth Authenticate, logger logger.Logger) http.HandlerFunc {
+	if hub == nil {
+		hub = NewHub()
+	}
 
 	// 获取广播接口
 	// ServeWs will serve the page request "/ws", and update the http to websocket
@@ -44,6 +57,21 @@ func WebsocketHandler(process ProcessMixHttpRequest, connected Connected, logger
 			return
 		}
 
+		var (
+			session interface{}
+			userid  uint
+			expire  time.Time
+		)
+		if auth != nil {
+			var err error
+			session, userid, expire, err = auth(r)
+			if err != nil {
+				logger.Warnf("websocket authenticate failed: %v", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			http.Error(w, "服务器错误, 请联系管理员", http.StatusInternalServerError)
@@ -52,19 +80,26 @@ func WebsocketHandler(process ProcessMixHttpRequest, connected Connected, logger
 		}
 
 		client := &Client{
-			conn: conn,
-			Send: make(chan []byte, runtime.NumCPU()*2),
+			conn:     conn,
+			Send:     make(chan []byte, hub.queueSize),
+			ID:       atomic.AddUint64(&clientSeq, 1),
+			Addr:     r.RemoteAddr,
+			hub:      hub,
+			overflow: hub.overflow,
+		}
+		if session != nil {
+			client.Bind(session, userid, expire)
 		}
 		hub.register <- client
 
-		fn, clear := process(r)
-		go client.readPump(hub, fn, clear, logger)
+		fn, disconnected := process(r)
+		go client.readPump(hub, fn, disconnected, logger)
 		go client.writePump(logger)
 
 		if connected != nil {
-			// 预推送数据, 如果预推送的量超过send的cache量，就会阻塞,
+			// 预推送数据, 超过发送队列长度时按溢出策略处理
 			// 必须在client.writePump启动后再推送
-			connected(client.Send)
+			connected(client)
 		}
 	}
 }
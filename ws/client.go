@@ -2,6 +2,8 @@ package ws
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eruca/bisel/logger"
@@ -17,6 +19,9 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// CloseTokenExpired 绑定的token过期时关闭连接的close code
+	CloseTokenExpired = 4001
 )
 
 var upgrader = websocket.Upgrader{
@@ -31,14 +36,205 @@ type Client struct {
 	conn   *websocket.Conn
 	Send   chan []byte
 	Userid uint
+	// ID 连接的序号，Addr 客户端地址，用于管理及日志
+	ID   uint64
+	Addr string
+	hub  *Hub
+
+	mu      sync.Mutex
+	session interface{}
+	expire  *time.Timer
+	closed  bool
+	// 发送队列溢出的处理，slow表示已因溢出而关闭
+	overflow OverflowPolicy
+	dropped  uint64
+	slow     bool
+}
+
+// Subscribe 订阅topics，之后发布到这些topic的广播会发送给该连接
+func (c *Client) Subscribe(topics ...string) {
+	c.hub.Subscribe(c, topics...)
+}
+
+// Unsubscribe 取消订阅
+func (c *Client) Unsubscribe(topics ...string) {
+	c.hub.Unsubscribe(c, topics...)
+}
+
+// Push 将data放入发送队列，不会阻塞，可以在任意goroutine中调用
+// 队列已满时按OverflowPolicy处理，data被丢弃或连接已关闭时返回false
+func (c *Client) Push(data []byte) bool {
+	return c.enqueue(data, c.overflow)
 }
 
-func (c *Client) readPump(hub *Hub, fn Process, clear ClearUserID, logger logger.Logger) {
+// Reply 发送对该连接请求的应答，队列已满时不丢弃应答:
+// DropNew也丢弃队列中最早的消息(广播)，Disconnect仍关闭连接
+// 连接已关闭或因溢出关闭时返回false
+func (c *Client) Reply(data []byte) bool {
+	policy := c.overflow
+	if policy == DropNew {
+		policy = DropOldest
+	}
+	return c.enqueue(data, policy)
+}
+
+func (c *Client) enqueue(data []byte, policy OverflowPolicy) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.slow {
+		return false
+	}
+	select {
+	case c.Send <- data:
+		return true
+	default:
+	}
+
+	switch policy {
+	case DropOldest:
+		if cap(c.Send) == 0 {
+			break
+		}
+		// 持有c.mu时没有其他生产者，取出一个后必然有空位
+		select {
+		case <-c.Send:
+		default:
+		}
+		c.drop()
+		c.Send <- data
+		return true
+	case Disconnect:
+		c.slow = true
+		if c.hub != nil {
+			atomic.AddUint64(&c.hub.slowDisconnects, 1)
+		}
+		// 写close帧可能阻塞，不能占用调用者(hub)
+		go c.closeWith(CloseSlowConsumer, "send queue overflow")
+	}
+	c.drop()
+	return false
+}
+
+// drop 记录一条丢弃的消息，需持有c.mu
+func (c *Client) drop() {
+	c.dropped++
+	if c.hub != nil {
+		atomic.AddUint64(&c.hub.dropped, 1)
+	}
+}
+
+// stats 发送队列的统计
+func (c *Client) stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ClientStats{
+		ID:         c.ID,
+		UserID:     c.Userid,
+		Addr:       c.Addr,
+		QueueDepth: len(c.Send),
+		QueueSize:  cap(c.Send),
+		Dropped:    c.dropped,
+	}
+}
+
+// close 由hub注销时调用，之后Push不再发送
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.Send)
+	}
+}
+
+// Bind 将认证后的session绑定到该连接，之后该连接上的请求都使用它
+// 到expire时关闭连接，除非在此之前再次Bind(比如刷新了token)
+func (c *Client) Bind(session interface{}, userid uint, expire time.Time) {
+	defer c.reindex()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.session = session
+	c.Userid = userid
+	if c.expire != nil {
+		c.expire.Stop()
+	}
+	c.expire = time.AfterFunc(time.Until(expire), func() {
+		c.closeWith(CloseTokenExpired, "token expired")
+	})
+}
+
+// Extend 绑定的session有效期延长到expire(比如不透明session的滑动过期)，不改变绑定的用户
+func (c *Client) Extend(expire time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil {
+		return
+	}
+	if c.expire != nil {
+		c.expire.Stop()
+	}
+	c.expire = time.AfterFunc(time.Until(expire), func() {
+		c.closeWith(CloseTokenExpired, "token expired")
+	})
+}
+
+// Unbind 解除绑定(比如登出)，连接保持
+func (c *Client) Unbind() {
+	defer c.reindex()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.session = nil
+	c.Userid = 0
+	if c.expire != nil {
+		c.expire.Stop()
+		c.expire = nil
+	}
+}
+
+// UserID 返回绑定的用户，未认证时为0
+func (c *Client) UserID() uint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Userid
+}
+
+// reindex 绑定的用户改变后通知hub重新索引，不能持有c.mu
+func (c *Client) reindex() {
+	if c.hub != nil {
+		c.hub.bind <- c
+	}
+}
+
+// Session 返回绑定的session，未认证时为nil
+func (c *Client) Session() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// closeWith 发送close帧后关闭连接，readPump随之退出并注销该Client
+func (c *Client) closeWith(code int, text string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+func (c *Client) readPump(hub *Hub, fn Process, disconnected Disconnected, logger logger.Logger) {
 	defer func() {
 		logger.Infof("readPump client unregister conn close")
 		hub.unregister <- c
 		c.conn.Close()
-		clear(c.Userid)
+		c.mu.Lock()
+		if c.expire != nil {
+			c.expire.Stop()
+		}
+		c.mu.Unlock()
+		disconnected(c)
 	}()
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
@@ -1,46 +1,231 @@
 package ws
 
+// BroadcastRequest 广播请求
+// Users不为空时发送给这些用户的所有连接
+// 否则Topics为空时发送给所有连接，不为空时发送给订阅了其中任一topic的连接
+// Producer 产生该广播的连接，不再发送给它
 type BroadcastRequest struct {
 	Data     []byte
 	Producer chan []byte
+	Topics   []string
+	Users    []uint
+}
+
+// subscription 订阅或取消订阅
+type subscription struct {
+	client    *Client
+	topics    []string
+	subscribe bool
 }
 
 // Hub 代表所有Client的汇集地
 type Hub struct {
-	clients    map[*Client]struct{}
+	// 累计的统计，atomic访问，放在最前面保证64位对齐
+	dropped         uint64
+	slowDisconnects uint64
+
+	// 新连接的发送队列，由SetQueue设置
+	queueSize int
+	overflow  OverflowPolicy
+
+	clients map[*Client]struct{}
+	// topic => 订阅的连接，以及反向索引用于连接断开时清理
+	topics     map[string]map[*Client]struct{}
+	subscribed map[*Client]map[string]struct{}
+	// 用户 => 该用户的连接(可以有多个)，以及连接当前被索引的用户
+	users  map[uint]map[*Client]struct{}
+	userOf map[*Client]uint
+
 	broadcast  chan BroadcastRequest
 	register   chan *Client
 	unregister chan *Client
+	subscribe  chan subscription
+	bind       chan *Client
+	stats      chan chan Stats
 }
 
-func newHub() *Hub {
+// NewHub 启动一个Hub，可以在WebsocketHandler之外用它广播
+func NewHub() *Hub {
 	hub := &Hub{
 		clients:    make(map[*Client]struct{}),
+		topics:     make(map[string]map[*Client]struct{}),
+		subscribed: make(map[*Client]map[string]struct{}),
+		users:      make(map[uint]map[*Client]struct{}),
+		userOf:     make(map[*Client]uint),
 		broadcast:  make(chan BroadcastRequest),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		subscribe:  make(chan subscription),
+		bind:       make(chan *Client),
+		stats:      make(chan chan Stats),
+		queueSize:  DefaultQueueSize,
+		overflow:   Disconnect,
 	}
 
 	go hub.run()
 	return hub
 }
 
+// Broadcast 向所有连接广播，可以在任意goroutine中调用
+func (h *Hub) Broadcast(data []byte) {
+	h.broadcast <- BroadcastRequest{Data: data}
+}
+
+// Publish 发送给订阅了其中任一topic的连接
+func (h *Hub) Publish(data []byte, topics ...string) {
+	if len(topics) == 0 {
+		return
+	}
+	h.broadcast <- BroadcastRequest{Data: data, Topics: topics}
+}
+
+// SendToUsers 发送给这些用户的所有连接，用户不在线时丢弃
+func (h *Hub) SendToUsers(data []byte, userIDs ...uint) {
+	if len(userIDs) == 0 {
+		return
+	}
+	h.broadcast <- BroadcastRequest{Data: data, Users: userIDs}
+}
+
+// Subscribe 订阅topics，比如表名、table/id或自定义的名字
+func (h *Hub) Subscribe(client *Client, topics ...string) {
+	h.subscribe <- subscription{client: client, topics: topics, subscribe: true}
+}
+
+// Unsubscribe 取消订阅
+func (h *Hub) Unsubscribe(client *Client, topics ...string) {
+	h.subscribe <- subscription{client: client, topics: topics}
+}
+
 func (h *Hub) run() {
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = struct{}{}
+			h.indexUser(client)
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
-				close(client.Send)
+				h.unsubscribeAll(client)
+				h.unindexUser(client)
+				client.close()
+			}
+		case client := <-h.bind:
+			// 注册前的Bind在注册时索引
+			if _, ok := h.clients[client]; ok {
+				prev := h.userOf[client]
+				h.unindexUser(client)
+				h.indexUser(client)
+				// 订阅是按之前的用户授权的，登出或换了用户后取消
+				if h.userOf[client] != prev {
+					h.unsubscribeAll(client)
+				}
+			}
+		case sub := <-h.subscribe:
+			if _, ok := h.clients[sub.client]; !ok {
+				continue
+			}
+			for _, topic := range sub.topics {
+				if sub.subscribe {
+					h.add(sub.client, topic)
+				} else {
+					h.remove(sub.client, topic)
+				}
 			}
 		case req := <-h.broadcast:
-			for client := range h.clients {
+			// 不阻塞: 慢的连接按溢出策略处理，不影响其他连接
+			for client := range h.receivers(req) {
 				if client.Send != req.Producer {
-					client.Send <- req.Data
+					client.Push(req.Data)
 				}
 			}
+		case reply := <-h.stats:
+			reply <- h.collectStats()
 		}
 	}
 }
+
+// receivers 该广播的接收者(去重)
+func (h *Hub) receivers(req BroadcastRequest) map[*Client]struct{} {
+	if len(req.Users) > 0 {
+		return h.userClients(req.Users)
+	}
+
+	topics := req.Topics
+	if len(topics) == 0 {
+		return h.clients
+	}
+	if len(topics) == 1 {
+		return h.topics[topics[0]]
+	}
+	receivers := make(map[*Client]struct{})
+	for _, topic := range topics {
+		for client := range h.topics[topic] {
+			receivers[client] = struct{}{}
+		}
+	}
+	return receivers
+}
+
+func (h *Hub) add(client *Client, topic string) {
+	if h.topics[topic] == nil {
+		h.topics[topic] = make(map[*Client]struct{})
+	}
+	h.topics[topic][client] = struct{}{}
+	if h.subscribed[client] == nil {
+		h.subscribed[client] = make(map[string]struct{})
+	}
+	h.subscribed[client][topic] = struct{}{}
+}
+
+func (h *Hub) remove(client *Client, topic string) {
+	if delete(h.topics[topic], client); len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+	if delete(h.subscribed[client], topic); len(h.subscribed[client]) == 0 {
+		delete(h.subscribed, client)
+	}
+}
+
+func (h *Hub) unsubscribeAll(client *Client) {
+	for topic := range h.subscribed[client] {
+		h.remove(client, topic)
+	}
+}
+
+func (h *Hub) userClients(userIDs []uint) map[*Client]struct{} {
+	if len(userIDs) == 1 {
+		return h.users[userIDs[0]]
+	}
+	receivers := make(map[*Client]struct{})
+	for _, userID := range userIDs {
+		for client := range h.users[userID] {
+			receivers[client] = struct{}{}
+		}
+	}
+	return receivers
+}
+
+// indexUser 按连接当前绑定的用户索引，未认证的连接不索引
+func (h *Hub) indexUser(client *Client) {
+	userID := client.UserID()
+	if userID == 0 {
+		return
+	}
+	if h.users[userID] == nil {
+		h.users[userID] = make(map[*Client]struct{})
+	}
+	h.users[userID][client] = struct{}{}
+	h.userOf[client] = userID
+}
+
+func (h *Hub) unindexUser(client *Client) {
+	userID, ok := h.userOf[client]
+	if !ok {
+		return
+	}
+	delete(h.userOf, client)
+	if delete(h.users[userID], client); len(h.users[userID]) == 0 {
+		delete(h.users, userID)
+	}
+}
@@ -0,0 +1,51 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendToUsers(t *testing.T) {
+	hub := NewHub()
+	expire := time.Now().Add(time.Hour)
+
+	phone := newQueuedClient(hub, 4, DropNew)
+	phone.Bind("alice", 1, expire)
+	laptop := newQueuedClient(hub, 4, DropNew)
+	laptop.Bind("alice", 1, expire)
+	bob := newQueuedClient(hub, 4, DropNew)
+	bob.Bind("bob", 2, expire)
+	anonymous := newQueuedClient(hub, 4, DropNew)
+
+	// 发送给该用户的所有连接
+	hub.SendToUsers([]byte("1"), 1)
+	hub.Stats()
+	assert.Equal(t, []string{"1"}, drain(phone))
+	assert.Equal(t, []string{"1"}, drain(laptop))
+	assert.Empty(t, drain(bob))
+	assert.Empty(t, drain(anonymous))
+
+	// 断开一个连接，其他连接仍然收到
+	hub.unregister <- phone
+	hub.SendToUsers([]byte("2"), 1)
+	hub.Stats()
+	assert.Equal(t, []string{"2"}, drain(laptop))
+	assert.Contains(t, hub.users, uint(1))
+
+	// 最后一个连接断开后不再索引该用户
+	hub.unregister <- laptop
+	hub.SendToUsers([]byte("3"), 1, 2)
+	hub.Stats()
+	assert.Equal(t, []string{"3"}, drain(bob))
+	assert.NotContains(t, hub.users, uint(1))
+	assert.NotContains(t, hub.userOf, laptop)
+	assert.Len(t, hub.users, 1)
+
+	// 解除绑定同样清理
+	bob.Unbind()
+	hub.Stats()
+	assert.Empty(t, hub.users)
+	assert.Empty(t, hub.userOf)
+}
@@ -0,0 +1,100 @@
+package ws
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// OverflowPolicy 连接的发送队列满时如何处理新的消息
+type OverflowPolicy int
+
+const (
+	// DropOldest 丢弃队列中最早的消息
+	DropOldest OverflowPolicy = iota
+	// DropNew 丢弃新的消息
+	DropNew
+	// Disconnect 以CloseSlowConsumer关闭连接，客户端重连后重新同步
+	Disconnect
+)
+
+const (
+	// DefaultQueueSize 每个连接默认的发送队列长度
+	DefaultQueueSize = 256
+
+	// CloseSlowConsumer 发送队列溢出时关闭连接的close code
+	CloseSlowConsumer = 4008
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNew:
+		return "drop-new"
+	case Disconnect:
+		return "disconnect"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// ClientStats 单个连接的发送队列
+type ClientStats struct {
+	ID         uint64 `json:"id"`
+	UserID     uint   `json:"user_id,omitempty"`
+	Addr       string `json:"addr"`
+	QueueDepth int    `json:"queue_depth"`
+	QueueSize  int    `json:"queue_size"`
+	Dropped    uint64 `json:"dropped"`
+}
+
+// Stats 所有连接的发送队列统计
+type Stats struct {
+	Clients int `json:"clients"`
+	// Dropped 累计丢弃的消息，包括已断开的连接
+	Dropped uint64 `json:"dropped"`
+	// SlowDisconnects 累计因队列溢出而关闭的连接
+	SlowDisconnects uint64 `json:"slow_disconnects"`
+	MaxQueueDepth   int    `json:"max_queue_depth"`
+	// Queues 按队列深度从大到小排序
+	Queues []ClientStats `json:"queues"`
+}
+
+// SetQueue 设置之后建立的连接的发送队列长度及溢出策略，需在WebsocketHandler之前调用
+func (h *Hub) SetQueue(size int, overflow OverflowPolicy) *Hub {
+	if size <= 0 {
+		panic("发送队列长度必须大于0")
+	}
+	h.queueSize, h.overflow = size, overflow
+	return h
+}
+
+// Stats 统计当前连接的发送队列及累计丢弃的消息，可以在任意goroutine中调用
+func (h *Hub) Stats() Stats {
+	reply := make(chan Stats)
+	h.stats <- reply
+	return <-reply
+}
+
+func (h *Hub) collectStats() Stats {
+	stats := Stats{
+		Clients:         len(h.clients),
+		Dropped:         atomic.LoadUint64(&h.dropped),
+		SlowDisconnects: atomic.LoadUint64(&h.slowDisconnects),
+		Queues:          make([]ClientStats, 0, len(h.clients)),
+	}
+	for client := range h.clients {
+		cs := client.stats()
+		if cs.QueueDepth > stats.MaxQueueDepth {
+			stats.MaxQueueDepth = cs.QueueDepth
+		}
+		stats.Queues = append(stats.Queues, cs)
+	}
+	sort.Slice(stats.Queues, func(i, j int) bool {
+		if stats.Queues[i].QueueDepth != stats.Queues[j].QueueDepth {
+			return stats.Queues[i].QueueDepth > stats.Queues[j].QueueDepth
+		}
+		return stats.Queues[i].ID < stats.Queues[j].ID
+	})
+	return stats
+}
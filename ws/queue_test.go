@@ -0,0 +1,90 @@
+package ws
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newQueuedClient 注册到hub的连接，没有writePump，队列不会被取走
+func newQueuedClient(hub *Hub, size int, overflow OverflowPolicy) *Client {
+	client := &Client{Send: make(chan []byte, size), ID: uint64(size), hub: hub, overflow: overflow}
+	hub.register <- client
+	return client
+}
+
+func drain(client *Client) []string {
+	var messages []string
+	for len(client.Send) > 0 {
+		messages = append(messages, string(<-client.Send))
+	}
+	return messages
+}
+
+func TestQueueOverflow(t *testing.T) {
+	hub := NewHub()
+
+	oldest := newQueuedClient(hub, 2, DropOldest)
+	assert.True(t, oldest.Push([]byte("1")))
+	assert.True(t, oldest.Push([]byte("2")))
+	assert.True(t, oldest.Push([]byte("3")))
+	assert.Equal(t, []string{"2", "3"}, drain(oldest))
+
+	newest := newQueuedClient(hub, 3, DropNew)
+	assert.True(t, newest.Push([]byte("1")))
+	assert.True(t, newest.Push([]byte("2")))
+	assert.True(t, newest.Push([]byte("3")))
+	assert.False(t, newest.Push([]byte("4")))
+	// 应答不被丢弃，丢弃最早的广播
+	assert.True(t, newest.Reply([]byte("reply")))
+	assert.Equal(t, []string{"2", "3", "reply"}, drain(newest))
+
+	stats := hub.Stats()
+	assert.Equal(t, 2, stats.Clients)
+	assert.Equal(t, uint64(3), stats.Dropped)
+	assert.Equal(t, uint64(0), stats.SlowDisconnects)
+	require.Len(t, stats.Queues, 2)
+	assert.Equal(t, uint64(1), stats.Queues[0].Dropped)
+	assert.Equal(t, uint64(2), stats.Queues[1].Dropped)
+
+	newest.Push([]byte("5"))
+	stats = hub.Stats()
+	assert.Equal(t, 1, stats.MaxQueueDepth)
+	assert.Equal(t, uint64(3), stats.Queues[0].ID)
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if assert.NoError(t, err) {
+			conns <- conn
+		}
+	}))
+	defer server.Close()
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	defer peer.Close()
+
+	hub := NewHub()
+	client := newQueuedClient(hub, 1, Disconnect)
+	client.conn = <-conns
+
+	assert.True(t, client.Push([]byte("1")))
+	assert.False(t, client.Push([]byte("2")))
+	// 已因溢出关闭，应答也不再发送
+	assert.False(t, client.Reply([]byte("reply")))
+
+	_, _, err = peer.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseSlowConsumer), "%v", err)
+
+	stats := hub.Stats()
+	assert.Equal(t, uint64(1), stats.SlowDisconnects)
+	assert.Equal(t, uint64(1), stats.Dropped)
+}